@@ -8,6 +8,5 @@ require (
 	github.com/gorilla/mux v1.8.1
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
+	golang.org/x/crypto v0.48.0
 )
-
-require golang.org/x/crypto v0.48.0 // indirect
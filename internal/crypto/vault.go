@@ -0,0 +1,61 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidCiphertext = errors.New("invalid ciphertext")
+
+// Vault seals secrets with AES-256-GCM under a single master key.
+// Sealed values are laid out as nonce || ciphertext.
+type Vault struct {
+	aead cipher.AEAD
+}
+
+// NewVault expects the master key as 64 hex characters (32 bytes).
+func NewVault(masterKey string) (*Vault, error) {
+	key, err := hex.DecodeString(masterKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes encoded as hex")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Vault{aead: aead}, nil
+}
+
+// Encrypt seals plaintext. additionalData is authenticated but not stored, so
+// the same value must be passed to Decrypt.
+func (v *Vault) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return v.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func (v *Vault) Decrypt(sealed, additionalData []byte) ([]byte, error) {
+	nonceSize := v.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, ErrInvalidCiphertext
+	}
+
+	plaintext, err := v.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"github.com/lib/pq"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+func (ps *PostgresStore) createAuditLogTable() error {
+	query := `CREATE TABLE IF NOT EXISTS audit_log (
+        request_id UUID PRIMARY KEY,
+        user_id UUID NOT NULL,
+        api_key_id UUID NOT NULL,
+        member_id UUID,
+        provider VARCHAR(100) NOT NULL,
+        service VARCHAR(100) NOT NULL,
+        method VARCHAR(10) NOT NULL,
+        status_code INT NOT NULL,
+        cost BIGINT NOT NULL DEFAULT 0,
+        metered_cost BIGINT,
+        transaction_id UUID,
+        replayed BOOLEAN NOT NULL DEFAULT FALSE,
+        duration_ms BIGINT NOT NULL,
+        created_at TIMESTAMP NOT NULL
+    )`
+	if _, err := ps.db.Exec(query); err != nil {
+		return err
+	}
+
+	return ps.addColumns("audit_log", "member_id UUID", "metered_cost BIGINT")
+}
+
+// InsertAuditEntries writes a batch of audit entries with a single COPY. The
+// table has no foreign keys so that logging never fails, or waits, on the
+// rows it refers to.
+func (ps *PostgresStore) InsertAuditEntries(entries []*shared.AuditEntry) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(pq.CopyIn("audit_log",
+		"request_id", "user_id", "api_key_id", "member_id", "provider", "service", "method",
+		"status_code", "cost", "metered_cost", "transaction_id", "replayed", "duration_ms", "created_at"))
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		_, err := stmt.Exec(e.RequestId, e.UserId, e.ApiKeyId, e.MemberId, e.Provider, e.Service, e.Method,
+			e.StatusCode, e.Cost, e.MeteredCost, e.TransactionId, e.Replayed, e.DurationMs, e.CreatedAt)
+		if err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
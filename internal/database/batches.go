@@ -0,0 +1,193 @@
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+var ErrMixedBatch = errors.New("a charge batch must target a single wallet")
+
+// ChargeBatch applies charges against one wallet in a single database
+// transaction, so the batch commits once instead of once per charge. Each
+// charge debits the wallet as Charge does, through its shards and the store's
+// balance strategy. Charges are taken in order until the wallet runs out,
+// and every charge after the first that fails for lack of funds is rejected
+// with ErrInsufficientFunds, however small. A charge that fails for any other
+// reason is rolled back to its own savepoint and does not affect the others.
+//
+// It returns each charge's result and error in the order given. A non-nil
+// final error means the batch as a whole failed and nothing was applied.
+func (ps *PostgresStore) ChargeBatch(transactions []*shared.Transaction) ([]*shared.Transaction, []error, error) {
+	results := make([]*shared.Transaction, len(transactions))
+	errs := make([]error, len(transactions))
+	if len(transactions) == 0 {
+		return results, errs, nil
+	}
+
+	userId := transactions[0].UserId
+	for _, transaction := range transactions {
+		if transaction.UserId != userId {
+			return nil, nil, ErrMixedBatch
+		}
+	}
+
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer tx.Rollback()
+
+	budgets, err := lockBatchBudgets(tx, transactions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var exists bool
+	queryRead := `SELECT EXISTS (SELECT 1 FROM balances WHERE user_id = $1)`
+	if err := tx.QueryRow(queryRead, userId).Scan(&exists); err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, fmt.Errorf("User %v not found", userId)
+	}
+
+	var exhausted bool
+	for i, transaction := range transactions {
+		if exhausted {
+			errs[i] = ErrInsufficientFunds
+			continue
+		}
+		if transaction.Amount <= 0 {
+			errs[i] = ErrAmountNotGreaterThanZero
+			continue
+		}
+
+		var budget *apiKeyBudget
+		if transaction.ApiKeyId != nil {
+			var ok bool
+			if budget, ok = budgets[*transaction.ApiKeyId]; !ok {
+				errs[i] = ErrInvalidApiKey
+				continue
+			}
+		}
+
+		if _, err := tx.Exec(`SAVEPOINT batch_charge`); err != nil {
+			return nil, nil, err
+		}
+
+		result, err := ps.applyBatchedCharge(tx, transaction, budget)
+		if err != nil {
+			if _, err := tx.Exec(`ROLLBACK TO SAVEPOINT batch_charge`); err != nil {
+				return nil, nil, err
+			}
+			errs[i] = err
+			exhausted = errors.Is(err, ErrInsufficientFunds)
+			continue
+		}
+
+		if _, err := tx.Exec(`RELEASE SAVEPOINT batch_charge`); err != nil {
+			return nil, nil, err
+		}
+		results[i] = result
+	}
+
+	return results, errs, tx.Commit()
+}
+
+// applyBatchedCharge does for one charge of a batch what Charge does.
+func (ps *PostgresStore) applyBatchedCharge(tx *sql.Tx, transaction *shared.Transaction, budget *apiKeyBudget) (*shared.Transaction, error) {
+	requestHash := requestFingerprint(transaction.Type, transaction.Amount, transaction.ApiKeyId, transaction.ProviderId)
+
+	queryTransaction := `
+		INSERT INTO transactions (transaction_id, user_id, idempotency_key, request_hash, amount, type, api_key_id, provider_id, member_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (user_id, idempotency_key) WHERE idempotency_expired_at IS NULL DO NOTHING
+	`
+
+	result, err := tx.Exec(queryTransaction, transaction.TransactionId, transaction.UserId, transaction.IdempotencyKey, requestHash, transaction.Amount, transaction.Type, transaction.ApiKeyId, transaction.ProviderId, transaction.MemberId, transaction.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowAffected == 0 {
+		oldTransaction, err := readIdempotentTransaction(tx, transaction.UserId, transaction.IdempotencyKey, requestHash)
+		return oldTransaction, err
+	}
+
+	if err := ps.debitWallet(tx, transaction.UserId, transaction.Amount); err != nil {
+		return nil, err
+	}
+
+	walletId, err := walletAccountId(tx, transaction.UserId)
+	if err != nil {
+		return nil, err
+	}
+	creditId, err := chargeAccountId(tx, transaction.ProviderId)
+	if err != nil {
+		return nil, err
+	}
+	if err := postMovement(tx, &transaction.TransactionId, "CHARGE", walletId, creditId, transaction.Amount); err != nil {
+		return nil, err
+	}
+
+	if err := checkApiKeyBudget(tx, budget); err != nil {
+		return nil, err
+	}
+
+	if err := checkWalletLimits(tx, transaction.UserId); err != nil {
+		return nil, err
+	}
+
+	transaction.Status = "PENDING"
+
+	return transaction, nil
+}
+
+// lockBatchBudgets reads the budget of every API key in the batch and takes
+// the lineage locks of those with limits, in UUID order so that concurrent
+// batches cannot deadlock, and before the balance lock as Charge does. Keys
+// that do not exist are left out.
+func lockBatchBudgets(tx *sql.Tx, transactions []*shared.Transaction) (map[uuid.UUID]*apiKeyBudget, error) {
+	budgets := make(map[uuid.UUID]*apiKeyBudget)
+	lineageIds := []uuid.UUID{}
+	for _, transaction := range transactions {
+		if transaction.ApiKeyId == nil {
+			continue
+		}
+		if _, ok := budgets[*transaction.ApiKeyId]; ok {
+			continue
+		}
+		budget, err := readApiKeyBudget(tx, transaction.ApiKeyId)
+		if errors.Is(err, ErrInvalidApiKey) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		budgets[*transaction.ApiKeyId] = budget
+		if !budget.IsUnlimited() && !slices.Contains(lineageIds, budget.lineageId) {
+			lineageIds = append(lineageIds, budget.lineageId)
+		}
+	}
+	slices.SortFunc(lineageIds, func(a, b uuid.UUID) int {
+		return bytes.Compare(a[:], b[:])
+	})
+
+	for _, lineageId := range lineageIds {
+		if err := lockApiKeyLineage(tx, lineageId); err != nil {
+			return nil, err
+		}
+	}
+	return budgets, nil
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+var ErrBudgetExceeded = errors.New("API key budget exceeded")
+
+// apiKeyBudget is an API key's limits and the lineage they are spent
+// against. Rotating a key starts no new lineage, so a replacement key keeps
+// spending against what its predecessors spent.
+type apiKeyBudget struct {
+	shared.ApiKeyBudget
+	lineageId uuid.UUID
+}
+
+// lockApiKeyBudget reads a key's budget and, if it has limits, takes the row
+// lock that serializes every charge made within its lineage, so the spend
+// summed by checkApiKeyBudget cannot change under it. It must be taken before
+// the balance row lock. A key without limits takes no lock; a limit set on it
+// applies to the charges that start afterwards. A nil key has no budget.
+func lockApiKeyBudget(tx *sql.Tx, apiKeyId *uuid.UUID) (*apiKeyBudget, error) {
+	budget, err := readApiKeyBudget(tx, apiKeyId)
+	if err != nil || budget == nil || budget.IsUnlimited() {
+		return budget, err
+	}
+	return budget, lockApiKeyLineage(tx, budget.lineageId)
+}
+
+func readApiKeyBudget(tx *sql.Tx, apiKeyId *uuid.UUID) (*apiKeyBudget, error) {
+	if apiKeyId == nil {
+		return nil, nil
+	}
+
+	budget := new(apiKeyBudget)
+	query := `SELECT hard_cap, daily_limit, weekly_limit, monthly_limit, lineage_id FROM api_keys WHERE api_key_id = $1`
+	err := tx.QueryRow(query, apiKeyId).Scan(&budget.HardCap, &budget.DailyLimit, &budget.WeeklyLimit, &budget.MonthlyLimit, &budget.lineageId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidApiKey
+		}
+		return nil, err
+	}
+	return budget, nil
+}
+
+// lockApiKeyLineage locks the first key of a lineage, which every key
+// rotated from it shares.
+func lockApiKeyLineage(tx *sql.Tx, lineageId uuid.UUID) error {
+	_, err := tx.Exec(`SELECT 1 FROM api_keys WHERE api_key_id = $1 FOR UPDATE`, lineageId)
+	return err
+}
+
+// checkApiKeyBudget sums the live charges of the key's lineage, including any
+// written earlier in tx, and fails with ErrBudgetExceeded if a limit is
+// passed.
+func checkApiKeyBudget(tx *sql.Tx, budget *apiKeyBudget) error {
+	if budget == nil || budget.IsUnlimited() {
+		return nil
+	}
+
+	match := `api_key_id IN (SELECT api_key_id FROM api_keys WHERE lineage_id = $1)`
+	exceeded, err := spendExceeds(tx, match, budget.lineageId, &budget.ApiKeyBudget)
+	if err != nil {
+		return err
+	}
+	if exceeded {
+		return ErrBudgetExceeded
+	}
+	return nil
+}
+
+// spendExceeds reports whether the live charges matched by match, a condition
+// on $1 = id, pass any of the limits. Windows are calendar periods in UTC;
+// weeks start on Monday.
+func spendExceeds(tx *sql.Tx, match string, id uuid.UUID, limits *shared.ApiKeyBudget) (bool, error) {
+	now := time.Now().UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	weekStart := dayStart.AddDate(0, 0, -((int(dayStart.Weekday()) + 6) % 7))
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	query := `
+		SELECT
+			COALESCE(SUM(amount), 0),
+			COALESCE(SUM(amount) FILTER (WHERE created_at >= $2), 0),
+			COALESCE(SUM(amount) FILTER (WHERE created_at >= $3), 0),
+			COALESCE(SUM(amount) FILTER (WHERE created_at >= $4), 0)
+		FROM transactions
+		WHERE ` + match + ` AND type = 'CHARGE' AND status <> 'FAILED'
+	`
+
+	var total, daily, weekly, monthly int64
+	err := tx.QueryRow(query, id, dayStart, weekStart, monthStart).Scan(&total, &daily, &weekly, &monthly)
+	if err != nil {
+		return false, err
+	}
+
+	return exceeds(total, limits.HardCap) || exceeds(daily, limits.DailyLimit) || exceeds(weekly, limits.WeeklyLimit) || exceeds(monthly, limits.MonthlyLimit), nil
+}
+
+func exceeds(spent int64, limit *int64) bool {
+	return limit != nil && spent > *limit
+}
+
+func (ps *PostgresStore) SetApiKeyBudget(userId uuid.UUID, apiKeyId uuid.UUID, budget *shared.ApiKeyBudget) error {
+	query := `
+		UPDATE api_keys SET hard_cap = $3, daily_limit = $4, weekly_limit = $5, monthly_limit = $6
+		WHERE user_id = $1 AND api_key_id = $2
+	`
+	result, err := ps.db.Exec(query, userId, apiKeyId, budget.HardCap, budget.DailyLimit, budget.WeeklyLimit, budget.MonthlyLimit)
+	if err != nil {
+		return err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowAffected == 0 {
+		return ErrApiKeyNotFound
+	}
+	return nil
+}
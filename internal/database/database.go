@@ -1,7 +1,9 @@
 package database
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
@@ -9,12 +11,17 @@ import (
 
 	"github.com/google/uuid"
 	_ "github.com/joho/godotenv/autoload"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/minh20051202/ticket-system-backend/internal/shared"
 )
 
 var ErrInsufficientFunds = errors.New("insufficient funds")
 var ErrAmountNotGreaterThanZero = errors.New("amount not greater than 0")
+var ErrInvalidApiKey = errors.New("invalid API key")
+var ErrApiKeyNotFound = errors.New("API key not found")
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used with different parameters")
+var ErrTransactionNotFound = errors.New("transaction not found")
+var ErrNotRefundable = errors.New("only charges can be refunded")
 
 type Storage interface {
 	CreateUserWithBalance(*shared.User) error
@@ -24,17 +31,89 @@ type Storage interface {
 	GetUserByUsername(string) (*shared.User, error)
 
 	GetBalanceById(uuid.UUID) (*shared.Balance, error)
+	BalanceStrategy() string
+	SetBalanceShards(uuid.UUID, int) error
+	RebalanceShards(uuid.UUID) (bool, error)
+	GetShardedWallets() ([]uuid.UUID, error)
+	AcquireLease(uuid.UUID, int64, int64, time.Time) (*shared.BalanceLease, error)
+	FlushLease(uuid.UUID, []*shared.Transaction, time.Time) ([]error, error)
+	ReleaseLease(uuid.UUID, []*shared.Transaction) ([]error, error)
+	ExpireLeases(time.Time) (int64, error)
+	ReleaseExpiredLease(uuid.UUID) (*shared.BalanceLease, error)
+	GetIdempotentTransactions(uuid.UUID) (map[string]*shared.Transaction, error)
 	CreateApiKey(*shared.ApiKey) error
 	GetUserIdByApiKey(string) (uuid.UUID, error)
+	GetApiKeyByHash(string) (*shared.ApiKey, error)
+	GetApiKeysByUser(uuid.UUID) ([]*shared.ApiKey, error)
+	RevokeApiKey(uuid.UUID, uuid.UUID) error
+	RotateApiKey(uuid.UUID, *shared.ApiKey, time.Time) error
+	SetApiKeyBudget(uuid.UUID, uuid.UUID, *shared.ApiKeyBudget) error
+	SetApiKeyScope(uuid.UUID, uuid.UUID, *shared.ApiKeyScope) error
+
+	ExpireIdempotencyKeys(time.Time) (int64, error)
+	PruneProxyResponses(time.Time) (int64, error)
+	ClaimIdempotencyKey(uuid.UUID, string, string, uuid.UUID, time.Time) (*shared.ProxyResponse, bool, error)
+	GetProxyResponse(uuid.UUID, string) (*shared.ProxyResponse, error)
+	CompleteIdempotencyKey(*shared.ProxyResponse) error
+	ReleaseIdempotencyKey(uuid.UUID, string, uuid.UUID) error
+
+	InsertAuditEntries([]*shared.AuditEntry) error
+
+	GetWalletLedger(uuid.UUID) (*shared.WalletLedger, error)
+	GetJournalEntries(uuid.UUID) ([]*shared.JournalEntry, error)
+	Reconcile(time.Time) (*shared.ReconciliationReport, error)
+	GetLatestReconciliationReport() (*shared.ReconciliationReport, error)
 
 	Charge(*shared.Transaction) (*shared.Transaction, error)
+	ChargeBatch([]*shared.Transaction) ([]*shared.Transaction, []error, error)
 	Deposit(*shared.Transaction) (*shared.Transaction, error)
+	Refund(uuid.UUID) (*shared.Transaction, error)
+	Transfer(*shared.Transaction) (*shared.Transaction, error)
+
+	CreateOrganization(*shared.Organization, uuid.UUID) error
+	GetOrganization(uuid.UUID, uuid.UUID) (*shared.Organization, error)
+	GetOrganizationsByMember(uuid.UUID) ([]*shared.Organization, error)
+	GetOrganizationMembers(uuid.UUID) ([]*shared.OrganizationMember, error)
+	AddOrganizationMember(uuid.UUID, uuid.UUID, string) error
+	UpdateOrganizationMemberRole(uuid.UUID, uuid.UUID, string) error
+	RemoveOrganizationMember(uuid.UUID, uuid.UUID) error
+	GetMemberRole(uuid.UUID, uuid.UUID) (string, error)
+
+	CreateSubWallet(*shared.SubWallet) error
+	GetSubWallet(uuid.UUID) (*shared.SubWallet, error)
+	GetSubWalletsByParent(uuid.UUID) ([]*shared.SubWallet, error)
+	SetSubWalletLimits(uuid.UUID, *shared.ApiKeyBudget) error
+	SweepSubWallet(*shared.Transaction) (*shared.Transaction, error)
+
+	Authorize(*shared.Transaction, int64) (*shared.Hold, error)
+	Capture(uuid.UUID, int64) (*shared.Hold, error)
+	Void(uuid.UUID) (*shared.Hold, error)
+	GetHoldById(uuid.UUID) (*shared.Hold, error)
 	UpdateTransactionStatus(uuid.UUID, string) error
+	GetStalePendingTransactions(time.Time, time.Time, int) ([]*shared.Transaction, error)
+	DeferSettlement(uuid.UUID, time.Time, time.Duration, time.Duration) (int, error)
+	GetUpstreamResult(uuid.UUID) (int, *int64, error)
+	ConfirmTransaction(uuid.UUID, string) (bool, error)
+	SetTransactionReason(uuid.UUID, string) error
 	GetAllTransactions() ([]*shared.Transaction, error)
+
+	CreateProvider(*shared.Provider) error
+	GetAllProviders() ([]*shared.Provider, error)
+	GetProviderByName(string) (*shared.Provider, error)
+	UpsertProviderService(*shared.ProviderService) (*shared.ProviderService, error)
+	GetServicesByProvider(string) ([]*shared.ProviderService, error)
+	GetProviderService(string, string) (*shared.Provider, *shared.ProviderService, error)
+
+	CreateProviderSecret(*shared.ProviderSecret) error
+	GetProviderSecrets(uuid.UUID) ([]*shared.ProviderSecret, error)
+	GetActiveProviderSecrets(uuid.UUID) ([]*shared.ProviderSecret, error)
+	RetireProviderSecret(uuid.UUID, uuid.UUID) error
+	RecordSecretUsage(uuid.UUID, uuid.UUID) error
 }
 
 type PostgresStore struct {
-	db *sql.DB
+	db       *sql.DB
+	strategy balanceStrategy
 }
 
 var (
@@ -48,6 +127,11 @@ var (
 func New() (*PostgresStore, error) {
 	connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=Asia/Ho_Chi_Minh", host, username, password, database, port)
 
+	strategy, err := newBalanceStrategy(balanceStrategyName)
+	if err != nil {
+		return nil, err
+	}
+
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
@@ -61,7 +145,8 @@ func New() (*PostgresStore, error) {
 	db.SetConnMaxIdleTime(5 * time.Minute)
 
 	return &PostgresStore{
-		db: db,
+		db:       db,
+		strategy: strategy,
 	}, nil
 }
 
@@ -72,76 +157,296 @@ func (ps *PostgresStore) Init() error {
 	if err := ps.createBalanceTable(); err != nil {
 		return err
 	}
-	if err := ps.createTransactionTable(); err != nil {
+	if err := ps.createBalanceShardTable(); err != nil {
+		return err
+	}
+	if err := ps.createBalanceLeaseTable(); err != nil {
+		return err
+	}
+	if err := ps.createLedgerAccountTable(); err != nil {
+		return err
+	}
+	if err := ps.createOrganizationMemberTable(); err != nil {
+		return err
+	}
+	if err := ps.createSubWalletTable(); err != nil {
 		return err
 	}
 	if err := ps.createApiKeyTable(); err != nil {
 		return err
 	}
-	return nil
+	if err := ps.createApiKeyScopeTable(); err != nil {
+		return err
+	}
+	if err := ps.createProviderTable(); err != nil {
+		return err
+	}
+	if err := ps.createProviderServiceTable(); err != nil {
+		return err
+	}
+	if err := ps.createTransactionTable(); err != nil {
+		return err
+	}
+	if err := ps.createJournalTables(); err != nil {
+		return err
+	}
+	if err := ps.createHoldTable(); err != nil {
+		return err
+	}
+	if err := ps.createProxyResponseTable(); err != nil {
+		return err
+	}
+	if err := ps.createProviderSecretTable(); err != nil {
+		return err
+	}
+	if err := ps.createSecretUsageTable(); err != nil {
+		return err
+	}
+	if err := ps.createAuditLogTable(); err != nil {
+		return err
+	}
+	if err := ps.createReconciliationTables(); err != nil {
+		return err
+	}
+	return ps.backfillWalletAccounts()
 }
 
 func (ps *PostgresStore) Close() error {
 	return ps.db.Close()
 }
 
+// BalanceStrategy names the strategy Charge uses to debit balances.
+func (ps *PostgresStore) BalanceStrategy() string {
+	return ps.strategy.name()
+}
+
 func (ps *PostgresStore) createUserTable() error {
 	query := `CREATE TABLE IF NOT EXISTS users (
         user_id UUID PRIMARY KEY,
         username VARCHAR(50) UNIQUE NOT NULL,
         email VARCHAR(255) UNIQUE NOT NULL,
         password VARCHAR(255) NOT NULL,
+        kind VARCHAR(20) NOT NULL CHECK (kind IN ('USER', 'ORGANIZATION', 'WALLET')) DEFAULT 'USER',
         created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
     )`
-	_, err := ps.db.Exec(query)
-	return err
+	if _, err := ps.db.Exec(query); err != nil {
+		return err
+	}
+
+	if err := ps.addColumn("users", "kind VARCHAR(20) NOT NULL CHECK (kind IN ('USER', 'ORGANIZATION', 'WALLET')) DEFAULT 'USER'"); err != nil {
+		return err
+	}
+	return ps.widenCheck("users", "users_kind_check", "WALLET", "kind IN ('USER', 'ORGANIZATION', 'WALLET')")
 }
 
 func (ps *PostgresStore) createBalanceTable() error {
 	query := `CREATE TABLE IF NOT EXISTS balances (
         user_id UUID PRIMARY KEY,
         balance BIGINT DEFAULT 0 CHECK(balance >= 0),
+        held BIGINT DEFAULT 0 CHECK(held >= 0),
+        shard_count INT NOT NULL DEFAULT 0,
+        leased BIGINT NOT NULL DEFAULT 0 CHECK (leased >= 0),
+        version BIGINT NOT NULL DEFAULT 0,
         created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
         CONSTRAINT fk_balance_user
             FOREIGN KEY (user_id)
                 REFERENCES users(user_id)
                     ON DELETE RESTRICT
-    )`
-	_, err := ps.db.Exec(query)
-	return err
+    );
+
+    CREATE OR REPLACE FUNCTION bump_balance_version() RETURNS trigger AS $$
+    BEGIN
+        NEW.version := OLD.version + 1;
+        RETURN NEW;
+    END;
+    $$ LANGUAGE plpgsql;
+
+    DROP TRIGGER IF EXISTS balances_version ON balances;
+    CREATE TRIGGER balances_version
+        BEFORE UPDATE ON balances
+        FOR EACH ROW EXECUTE FUNCTION bump_balance_version()`
+	// Every write to a balance row bumps its version, whichever code path
+	// makes it, so the optimistic strategy never overwrites a newer balance.
+	if _, err := ps.db.Exec(query); err != nil {
+		return err
+	}
+
+	return ps.addColumns("balances",
+		"held BIGINT DEFAULT 0 CHECK(held >= 0)",
+		"shard_count INT NOT NULL DEFAULT 0",
+		"leased BIGINT NOT NULL DEFAULT 0 CHECK (leased >= 0)",
+		"version BIGINT NOT NULL DEFAULT 0",
+	)
 }
 
 func (ps *PostgresStore) createTransactionTable() error {
 	query := `CREATE TABLE IF NOT EXISTS transactions (
         transaction_id UUID PRIMARY KEY,
         user_id UUID NOT NULL,
-        idempotency_key VARCHAR(255) UNIQUE NOT NULL,
+        idempotency_key VARCHAR(255) NOT NULL,
+        request_hash VARCHAR(64) NOT NULL DEFAULT '',
+        idempotency_expired_at TIMESTAMP,
         amount BIGINT NOT NULL,
-		type VARCHAR(20) NOT NULL CHECK (type IN ('CHARGE', 'DEPOSIT')),
+		type VARCHAR(20) NOT NULL CHECK (type IN ('CHARGE', 'DEPOSIT', 'PROMO', 'REFUND', 'TRANSFER')),
         status VARCHAR(20) NOT NULL CHECK (status IN ('PENDING', 'FAILED', 'SUCCEEDED')) DEFAULT 'PENDING', 
+        status_reason TEXT NOT NULL DEFAULT '',
+        settlement_attempts INT NOT NULL DEFAULT 0,
+        next_attempt_at TIMESTAMP,
+        parent_transaction_id UUID,
+        api_key_id UUID,
+        provider_id UUID,
+        counterparty_id UUID,
+        member_id UUID,
         created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 
         CONSTRAINT fk_transaction_user
             FOREIGN KEY (user_id)
+                REFERENCES users(user_id)
+                    ON DELETE RESTRICT,
+        CONSTRAINT fk_transaction_parent
+            FOREIGN KEY (parent_transaction_id)
+                REFERENCES transactions(transaction_id)
+                    ON DELETE RESTRICT,
+        CONSTRAINT fk_transaction_apikey
+            FOREIGN KEY (api_key_id)
+                REFERENCES api_keys(api_key_id)
+                    ON DELETE RESTRICT,
+        CONSTRAINT fk_transaction_provider
+            FOREIGN KEY (provider_id)
+                REFERENCES providers(provider_id)
+                    ON DELETE RESTRICT,
+        CONSTRAINT fk_transaction_counterparty
+            FOREIGN KEY (counterparty_id)
+                REFERENCES users(user_id)
+                    ON DELETE RESTRICT,
+        CONSTRAINT fk_transaction_member
+            FOREIGN KEY (member_id)
                 REFERENCES users(user_id)
                     ON DELETE RESTRICT
     )`
-	_, err := ps.db.Exec(query)
+	if _, err := ps.db.Exec(query); err != nil {
+		return err
+	}
+
+	// Keys used to be unique across all users.
+	if err := ps.dropConstraint("transactions", "transactions_idempotency_key_key"); err != nil {
+		return err
+	}
+	if err := ps.widenCheck("transactions", "transactions_type_check", "TRANSFER", "type IN ('CHARGE', 'DEPOSIT', 'PROMO', 'REFUND', 'TRANSFER')"); err != nil {
+		return err
+	}
+	err := ps.addColumns("transactions",
+		"request_hash VARCHAR(64) NOT NULL DEFAULT ''",
+		"idempotency_expired_at TIMESTAMP",
+		"status_reason TEXT NOT NULL DEFAULT ''",
+		"settlement_attempts INT NOT NULL DEFAULT 0",
+		"next_attempt_at TIMESTAMP",
+		"parent_transaction_id UUID CONSTRAINT fk_transaction_parent REFERENCES transactions(transaction_id) ON DELETE RESTRICT",
+		"api_key_id UUID CONSTRAINT fk_transaction_apikey REFERENCES api_keys(api_key_id) ON DELETE RESTRICT",
+		"provider_id UUID CONSTRAINT fk_transaction_provider REFERENCES providers(provider_id) ON DELETE RESTRICT",
+		"counterparty_id UUID CONSTRAINT fk_transaction_counterparty REFERENCES users(user_id) ON DELETE RESTRICT",
+		"member_id UUID CONSTRAINT fk_transaction_member REFERENCES users(user_id) ON DELETE RESTRICT",
+	)
+	if err != nil {
+		return err
+	}
+
+	// Idempotency keys are only reserved until they expire, after which the
+	// user may use them again.
+	queryIndex := `CREATE UNIQUE INDEX IF NOT EXISTS transactions_idempotency_key_idx
+        ON transactions (user_id, idempotency_key)
+        WHERE idempotency_expired_at IS NULL`
+	if _, err := ps.db.Exec(queryIndex); err != nil {
+		return err
+	}
+
+	// Budgets and wallet limits sum a key's or a wallet's charges by time.
+	queryApiKeyIndex := `CREATE INDEX IF NOT EXISTS transactions_api_key_idx
+        ON transactions (api_key_id, created_at)
+        WHERE api_key_id IS NOT NULL`
+	if _, err := ps.db.Exec(queryApiKeyIndex); err != nil {
+		return err
+	}
+	queryUserIndex := `CREATE INDEX IF NOT EXISTS transactions_user_idx ON transactions (user_id, created_at)`
+	if _, err := ps.db.Exec(queryUserIndex); err != nil {
+		return err
+	}
+
+	// Refund finds the refund of a charge through its parent.
+	queryParentIndex := `CREATE INDEX IF NOT EXISTS transactions_parent_idx
+        ON transactions (parent_transaction_id)
+        WHERE parent_transaction_id IS NOT NULL`
+	_, err = ps.db.Exec(queryParentIndex)
 	return err
 }
 
 func (ps *PostgresStore) createApiKeyTable() error {
 	query := `CREATE TABLE IF NOT EXISTS api_keys (
         api_key VARCHAR(255) PRIMARY KEY,
+        api_key_id UUID UNIQUE NOT NULL,
+        lineage_id UUID NOT NULL,
         user_id UUID NOT NULL,
         name VARCHAR(50) NOT NULL, 
+        prefix_hint VARCHAR(20) NOT NULL DEFAULT '',
+        last_used_at TIMESTAMP,
+        expires_at TIMESTAMP,
+        revoked_at TIMESTAMP,
+        hard_cap BIGINT CHECK (hard_cap >= 0),
+        daily_limit BIGINT CHECK (daily_limit >= 0),
+        weekly_limit BIGINT CHECK (weekly_limit >= 0),
+        monthly_limit BIGINT CHECK (monthly_limit >= 0),
+        max_call_cost BIGINT CHECK (max_call_cost >= 0),
+        allowed_methods TEXT[] NOT NULL DEFAULT '{}',
+        member_id UUID,
         created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
         CONSTRAINT fk_apikey_user
             FOREIGN KEY (user_id)
+                REFERENCES users(user_id)
+                    ON DELETE RESTRICT,
+        CONSTRAINT fk_apikey_member
+            FOREIGN KEY (member_id)
                 REFERENCES users(user_id)
                     ON DELETE RESTRICT
     )`
-	_, err := ps.db.Exec(query)
+	if _, err := ps.db.Exec(query); err != nil {
+		return err
+	}
+
+	// Keys issued before api_key_id existed get a random one.
+	err := ps.addColumn("api_keys", "api_key_id UUID NOT NULL DEFAULT gen_random_uuid()",
+		`ALTER TABLE api_keys ALTER COLUMN api_key_id DROP DEFAULT, ADD CONSTRAINT api_keys_api_key_id_key UNIQUE (api_key_id)`,
+	)
+	if err != nil {
+		return err
+	}
+	err = ps.addColumns("api_keys",
+		"prefix_hint VARCHAR(20) NOT NULL DEFAULT ''",
+		"last_used_at TIMESTAMP",
+		"expires_at TIMESTAMP",
+		"revoked_at TIMESTAMP",
+		"hard_cap BIGINT CHECK (hard_cap >= 0)",
+		"daily_limit BIGINT CHECK (daily_limit >= 0)",
+		"weekly_limit BIGINT CHECK (weekly_limit >= 0)",
+		"monthly_limit BIGINT CHECK (monthly_limit >= 0)",
+		"max_call_cost BIGINT CHECK (max_call_cost >= 0)",
+		"allowed_methods TEXT[] NOT NULL DEFAULT '{}'",
+		"member_id UUID CONSTRAINT fk_apikey_member REFERENCES users(user_id) ON DELETE RESTRICT",
+	)
+	if err != nil {
+		return err
+	}
+
+	// Keys issued before lineages were kept each start their own.
+	err = ps.addColumn("api_keys", "lineage_id UUID",
+		`UPDATE api_keys SET lineage_id = api_key_id`,
+		`ALTER TABLE api_keys ALTER COLUMN lineage_id SET NOT NULL`,
+	)
+	if err != nil {
+		return err
+	}
+
+	queryIndex := `CREATE INDEX IF NOT EXISTS api_keys_lineage_idx ON api_keys (lineage_id)`
+	_, err = ps.db.Exec(queryIndex)
 	return err
 }
 
@@ -172,6 +477,10 @@ func (ps *PostgresStore) CreateUserWithBalance(user *shared.User) error {
 		return err
 	}
 
+	if err := createWalletAccount(tx, user.UserId, user.CreatedAt); err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
 
@@ -180,7 +489,7 @@ func (ps *PostgresStore) UpdateUser(user *shared.User) error {
 }
 
 func (ps *PostgresStore) GetAllUsers() ([]*shared.User, error) {
-	rows, err := ps.db.Query("SELECT user_id, username, email, password, created_at FROM users")
+	rows, err := ps.db.Query("SELECT user_id, username, email, password, kind, created_at FROM users")
 
 	if err != nil {
 		return nil, err
@@ -200,7 +509,7 @@ func (ps *PostgresStore) GetAllUsers() ([]*shared.User, error) {
 }
 
 func (ps *PostgresStore) GetUserById(uuid uuid.UUID) (*shared.User, error) {
-	rows, err := ps.db.Query("SELECT user_id, username, email, password, created_at FROM users WHERE user_id = $1", uuid)
+	rows, err := ps.db.Query("SELECT user_id, username, email, password, kind, created_at FROM users WHERE user_id = $1", uuid)
 
 	if err != nil {
 		return nil, err
@@ -215,7 +524,7 @@ func (ps *PostgresStore) GetUserById(uuid uuid.UUID) (*shared.User, error) {
 }
 
 func (ps *PostgresStore) GetUserByUsername(username string) (*shared.User, error) {
-	rows, err := ps.db.Query("SELECT user_id, username, email, password, created_at FROM users WHERE username = $1", username)
+	rows, err := ps.db.Query("SELECT user_id, username, email, password, kind, created_at FROM users WHERE username = $1", username)
 
 	if err != nil {
 		return nil, err
@@ -236,13 +545,14 @@ func scanIntoUsers(rows *sql.Rows) (*shared.User, error) {
 		&user.Username,
 		&user.Email,
 		&user.Password,
+		&user.Kind,
 		&user.CreatedAt,
 	)
 	return user, err
 }
 
 func (ps *PostgresStore) GetBalanceById(uuid uuid.UUID) (*shared.Balance, error) {
-	rows, err := ps.db.Query("SELECT * FROM balances WHERE user_id = $1", uuid)
+	rows, err := ps.db.Query("SELECT b.user_id, "+availableBalance+", "+heldBalance+", b.leased, b.shard_count, b.created_at FROM balances b WHERE b.user_id = $1", uuid)
 
 	if err != nil {
 		return nil, err
@@ -261,6 +571,9 @@ func scanIntoBalances(rows *sql.Rows) (*shared.Balance, error) {
 	err := rows.Scan(
 		&balance.UserId,
 		&balance.Balance,
+		&balance.Held,
+		&balance.Leased,
+		&balance.Shards,
 		&balance.CreatedAt,
 	)
 	return balance, err
@@ -278,13 +591,15 @@ func (ps *PostgresStore) Charge(transaction *shared.Transaction) (*shared.Transa
 		return nil, ErrAmountNotGreaterThanZero
 	}
 
+	requestHash := requestFingerprint(transaction.Type, transaction.Amount, transaction.ApiKeyId, transaction.ProviderId)
+
 	queryTransaction := `
-		INSERT INTO transactions (transaction_id, user_id, idempotency_key, amount, type, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT (idempotency_key) DO NOTHING
+		INSERT INTO transactions (transaction_id, user_id, idempotency_key, request_hash, amount, type, api_key_id, provider_id, member_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (user_id, idempotency_key) WHERE idempotency_expired_at IS NULL DO NOTHING
 	`
 
-	result, err := tx.Exec(queryTransaction, transaction.TransactionId, transaction.UserId, transaction.IdempotencyKey, transaction.Amount, transaction.Type, transaction.CreatedAt)
+	result, err := tx.Exec(queryTransaction, transaction.TransactionId, transaction.UserId, transaction.IdempotencyKey, requestHash, transaction.Amount, transaction.Type, transaction.ApiKeyId, transaction.ProviderId, transaction.MemberId, transaction.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -294,38 +609,37 @@ func (ps *PostgresStore) Charge(transaction *shared.Transaction) (*shared.Transa
 		return nil, err
 	}
 	if rowAffected == 0 {
-		oldTransaction := &shared.Transaction{}
-		queryRead := `SELECT transaction_id, user_id, idempotency_key, amount, type, status, created_at FROM transactions WHERE idempotency_key = $1`
-		err = tx.QueryRow(queryRead, transaction.IdempotencyKey).Scan(&oldTransaction.TransactionId, &oldTransaction.UserId, &oldTransaction.IdempotencyKey, &oldTransaction.Amount, &oldTransaction.Type, &oldTransaction.Status, &oldTransaction.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		return oldTransaction, nil
+		return readIdempotentTransaction(tx, transaction.UserId, transaction.IdempotencyKey, requestHash)
 	}
 
-	var balance int64
-	queryRead := `SELECT balance FROM balances WHERE user_id = $1 FOR UPDATE`
-
-	err = tx.QueryRow(queryRead, transaction.UserId).Scan(&balance)
+	budget, err := lockApiKeyBudget(tx, transaction.ApiKeyId)
 	if err != nil {
 		return nil, err
 	}
 
-	if balance < int64(transaction.Amount) {
-		return nil, ErrInsufficientFunds
+	if err := ps.debitWallet(tx, transaction.UserId, transaction.Amount); err != nil {
+		return nil, err
 	}
 
-	newBalance := balance - int64(transaction.Amount)
-
-	queryUpdate := `
-        UPDATE balances 
-        SET balance = $1
-        WHERE user_id = $2
-    `
-	_, err = tx.Exec(queryUpdate, newBalance, transaction.UserId)
+	walletId, err := walletAccountId(tx, transaction.UserId)
 	if err != nil {
 		return nil, err
 	}
+	creditId, err := chargeAccountId(tx, transaction.ProviderId)
+	if err != nil {
+		return nil, err
+	}
+	if err := postMovement(tx, &transaction.TransactionId, "CHARGE", walletId, creditId, transaction.Amount); err != nil {
+		return nil, err
+	}
+
+	if err := checkApiKeyBudget(tx, budget); err != nil {
+		return nil, err
+	}
+
+	if err := checkWalletLimits(tx, transaction.UserId); err != nil {
+		return nil, err
+	}
 
 	transaction.Status = "PENDING"
 
@@ -344,13 +658,15 @@ func (ps *PostgresStore) Deposit(transaction *shared.Transaction) (*shared.Trans
 		return nil, ErrAmountNotGreaterThanZero
 	}
 
+	requestHash := requestFingerprint(transaction.Type, transaction.Amount)
+
 	queryTransaction := `
-		INSERT INTO transactions (transaction_id, user_id, idempotency_key, amount, type, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT (idempotency_key) DO NOTHING
+		INSERT INTO transactions (transaction_id, user_id, idempotency_key, request_hash, amount, type, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id, idempotency_key) WHERE idempotency_expired_at IS NULL DO NOTHING
 	`
 
-	result, err := tx.Exec(queryTransaction, transaction.TransactionId, transaction.UserId, transaction.IdempotencyKey, transaction.Amount, transaction.Type, transaction.CreatedAt)
+	result, err := tx.Exec(queryTransaction, transaction.TransactionId, transaction.UserId, transaction.IdempotencyKey, requestHash, transaction.Amount, transaction.Type, transaction.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -360,13 +676,7 @@ func (ps *PostgresStore) Deposit(transaction *shared.Transaction) (*shared.Trans
 		return nil, err
 	}
 	if rowAffected == 0 {
-		oldTransaction := &shared.Transaction{}
-		queryRead := `SELECT transaction_id, user_id, idempotency_key, amount, type, status, created_at FROM transactions WHERE idempotency_key = $1`
-		err = tx.QueryRow(queryRead, transaction.IdempotencyKey).Scan(&oldTransaction.TransactionId, &oldTransaction.UserId, &oldTransaction.IdempotencyKey, &oldTransaction.Amount, &oldTransaction.Type, &oldTransaction.Status, &oldTransaction.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		return oldTransaction, nil
+		return readIdempotentTransaction(tx, transaction.UserId, transaction.IdempotencyKey, requestHash)
 	}
 
 	var balance int64
@@ -389,11 +699,175 @@ func (ps *PostgresStore) Deposit(transaction *shared.Transaction) (*shared.Trans
 		return nil, err
 	}
 
+	// Promotional credit is issued by the platform rather than paid in.
+	source := "FUNDING"
+	if transaction.Type == "PROMO" {
+		source = "PROMO"
+	}
+	sourceId, err := systemAccountId(tx, source)
+	if err != nil {
+		return nil, err
+	}
+	walletId, err := walletAccountId(tx, transaction.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if err := postMovement(tx, &transaction.TransactionId, transaction.Type, sourceId, walletId, transaction.Amount); err != nil {
+		return nil, err
+	}
+
 	transaction.Status = "PENDING"
 
 	return transaction, tx.Commit()
 }
 
+// requestFingerprint hashes the parameters of a ledger request so a retry can
+// be told apart from a different request that reuses the idempotency key.
+func requestFingerprint(parts ...any) string {
+	h := sha256.New()
+	for _, part := range parts {
+		if p, ok := part.(*uuid.UUID); ok && p == nil {
+			part = ""
+		} else if ok {
+			part = *p
+		}
+		fmt.Fprintf(h, "%v|", part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readIdempotentTransaction returns the transaction an earlier request stored
+// under the same user and idempotency key. Keys are scoped per user, so one
+// user can never be handed another's transaction.
+func readIdempotentTransaction(tx *sql.Tx, userId uuid.UUID, idempotencyKey string, requestHash string) (*shared.Transaction, error) {
+	oldTransaction := &shared.Transaction{}
+	var oldRequestHash string
+	queryRead := `SELECT transaction_id, user_id, idempotency_key, request_hash, amount, type, status, api_key_id, created_at FROM transactions WHERE user_id = $1 AND idempotency_key = $2 AND idempotency_expired_at IS NULL`
+	err := tx.QueryRow(queryRead, userId, idempotencyKey).Scan(&oldTransaction.TransactionId, &oldTransaction.UserId, &oldTransaction.IdempotencyKey, &oldRequestHash, &oldTransaction.Amount, &oldTransaction.Type, &oldTransaction.Status, &oldTransaction.ApiKeyId, &oldTransaction.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if oldRequestHash != requestHash {
+		return nil, ErrIdempotencyKeyReused
+	}
+	return oldTransaction, nil
+}
+
+// ExpireIdempotencyKeys releases the idempotency keys of transactions created
+// before the given time so they can be reused. The transactions themselves are
+// kept. It returns the number of keys released.
+func (ps *PostgresStore) ExpireIdempotencyKeys(before time.Time) (int64, error) {
+	query := `
+		UPDATE transactions
+		SET idempotency_expired_at = $1
+		WHERE idempotency_expired_at IS NULL AND created_at < $2
+	`
+	result, err := ps.db.Exec(query, time.Now().UTC(), before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Refund reverses a charge: the wallet is credited back, a REFUND transaction
+// pointing at the charge is recorded and the charge is marked FAILED. Calling
+// it again for the same charge returns the existing refund without crediting
+// twice.
+func (ps *PostgresStore) Refund(chargeId uuid.UUID) (*shared.Transaction, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	charge := &shared.Transaction{}
+	queryCharge := `SELECT transaction_id, user_id, idempotency_key, amount, type, status, provider_id, created_at FROM transactions WHERE transaction_id = $1 FOR UPDATE`
+	err = tx.QueryRow(queryCharge, chargeId).Scan(&charge.TransactionId, &charge.UserId, &charge.IdempotencyKey, &charge.Amount, &charge.Type, &charge.Status, &charge.ProviderId, &charge.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrTransactionNotFound
+		}
+		return nil, err
+	}
+
+	if charge.Type != "CHARGE" {
+		return nil, ErrNotRefundable
+	}
+
+	var holdStatus string
+	err = tx.QueryRow(`SELECT status FROM holds WHERE transaction_id = $1`, chargeId).Scan(&holdStatus)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil && holdStatus != "CAPTURED" {
+		return nil, ErrHoldNotCaptured
+	}
+
+	// The charge row lock serializes concurrent refunds, so a refund that
+	// already exists here is the only one there will ever be.
+	oldRefund := &shared.Transaction{}
+	queryRefund := `SELECT transaction_id, user_id, idempotency_key, amount, type, status, parent_transaction_id, created_at FROM transactions WHERE parent_transaction_id = $1 AND type = 'REFUND'`
+	err = tx.QueryRow(queryRefund, chargeId).Scan(&oldRefund.TransactionId, &oldRefund.UserId, &oldRefund.IdempotencyKey, &oldRefund.Amount, &oldRefund.Type, &oldRefund.Status, &oldRefund.ParentTransactionId, &oldRefund.CreatedAt)
+	if err == nil {
+		return oldRefund, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	refund := &shared.Transaction{
+		TransactionId:       uuid.New(),
+		UserId:              charge.UserId,
+		IdempotencyKey:      fmt.Sprintf("refund:%v", chargeId),
+		Amount:              charge.Amount,
+		Type:                "REFUND",
+		Status:              "SUCCEEDED",
+		ParentTransactionId: &charge.TransactionId,
+		CreatedAt:           time.Now().UTC(),
+	}
+
+	queryTransaction := `
+		INSERT INTO transactions (transaction_id, user_id, idempotency_key, request_hash, amount, type, status, parent_transaction_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	_, err = tx.Exec(queryTransaction, refund.TransactionId, refund.UserId, refund.IdempotencyKey, requestFingerprint(refund.Type, refund.Amount, refund.ParentTransactionId), refund.Amount, refund.Type, refund.Status, refund.ParentTransactionId, refund.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	queryUpdate := `
+        UPDATE balances 
+        SET balance = balance + $1
+        WHERE user_id = $2
+    `
+	_, err = tx.Exec(queryUpdate, charge.Amount, charge.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	debitId, err := chargeAccountId(tx, charge.ProviderId)
+	if err != nil {
+		return nil, err
+	}
+	walletId, err := walletAccountId(tx, charge.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if charge.Amount > 0 {
+		if err := postMovement(tx, &refund.TransactionId, "REFUND", debitId, walletId, charge.Amount); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE transactions SET status = 'FAILED' WHERE transaction_id = $1`, chargeId)
+	if err != nil {
+		return nil, err
+	}
+
+	return refund, tx.Commit()
+}
+
 func (ps *PostgresStore) UpdateTransactionStatus(txId uuid.UUID, status string) error {
 	query := `UPDATE transactions SET status = $1 WHERE transaction_id = $2`
 	_, err := ps.db.Exec(query, status, txId)
@@ -401,7 +875,7 @@ func (ps *PostgresStore) UpdateTransactionStatus(txId uuid.UUID, status string)
 }
 
 func (ps *PostgresStore) GetAllTransactions() ([]*shared.Transaction, error) {
-	rows, err := ps.db.Query("SELECT * FROM transactions")
+	rows, err := ps.db.Query("SELECT transaction_id, user_id, idempotency_key, amount, type, status, status_reason, parent_transaction_id, api_key_id, provider_id, counterparty_id, member_id, created_at FROM transactions")
 
 	if err != nil {
 		return nil, err
@@ -427,28 +901,128 @@ func scanIntoTransactions(rows *sql.Rows) (*shared.Transaction, error) {
 		&transaction.UserId,
 		&transaction.IdempotencyKey,
 		&transaction.Amount,
+		&transaction.Type,
 		&transaction.Status,
+		&transaction.StatusReason,
+		&transaction.ParentTransactionId,
+		&transaction.ApiKeyId,
+		&transaction.ProviderId,
+		&transaction.CounterpartyId,
+		&transaction.MemberId,
 		&transaction.CreatedAt)
 	return transaction, err
 }
 
 func (ps *PostgresStore) GetUserIdByApiKey(apiKeyHash string) (uuid.UUID, error) {
-	var userId uuid.UUID
+	apiKey, err := ps.GetApiKeyByHash(apiKeyHash)
+	if err != nil {
+		return uuid.Nil, err
+	}
 
-	query := `SELECT user_id FROM api_keys WHERE api_key = $1`
+	return apiKey.UserId, nil
+}
+
+// GetApiKeyByHash resolves an active key and records it as used. Revoked keys,
+// keys past their expiry and keys of an organization, or of one of its
+// sub-wallets, whose member can no longer issue keys for the organization are
+// reported as ErrInvalidApiKey. last_used_at is refreshed at most once a
+// minute, so that authenticating does not write the key's row on every call.
+func (ps *PostgresStore) GetApiKeyByHash(apiKeyHash string) (*shared.ApiKey, error) {
+	now := time.Now().UTC()
+
+	query := `
+		SELECT ` + apiKeyColumns + `
+		FROM api_keys
+		WHERE api_key = $1
+			AND revoked_at IS NULL
+			AND (expires_at IS NULL OR expires_at > $2)
+			AND (member_id IS NULL OR EXISTS (
+				SELECT 1 FROM organization_members m
+				WHERE m.org_id = COALESCE((SELECT parent_id FROM sub_wallets WHERE wallet_id = api_keys.user_id), api_keys.user_id)
+					AND m.user_id = api_keys.member_id
+					AND m.role IN ('OWNER', 'ADMIN', 'DEVELOPER')
+			))
+	`
 
-	err := ps.db.QueryRow(query, apiKeyHash).Scan(&userId)
+	apiKey, err := scanApiKey(ps.db.QueryRow(query, apiKeyHash, now))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return uuid.Nil, fmt.Errorf("invalid API key")
+			return nil, ErrInvalidApiKey
 		}
-		return uuid.Nil, err
+		return nil, err
+	}
+
+	staleBefore := now.Add(-time.Minute)
+	if apiKey.LastUsedAt == nil || apiKey.LastUsedAt.Before(staleBefore) {
+		queryUsed := `
+			UPDATE api_keys SET last_used_at = $2
+			WHERE api_key = $1 AND (last_used_at IS NULL OR last_used_at < $3)
+		`
+		if _, err := ps.db.Exec(queryUsed, apiKeyHash, now, staleBefore); err != nil {
+			return nil, err
+		}
+		apiKey.LastUsedAt = &now
+	}
+
+	if err := ps.loadApiKeyServiceScopes([]*shared.ApiKey{apiKey}); err != nil {
+		return nil, err
 	}
 
-	return userId, nil
+	return apiKey, nil
 }
 
-func (ps *PostgresStore) CreateApiKey(apiKey *shared.ApiKey) error {
+func (ps *PostgresStore) GetApiKeysByUser(userId uuid.UUID) ([]*shared.ApiKey, error) {
+	query := `
+		SELECT ` + apiKeyColumns + `
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY created_at
+	`
+	rows, err := ps.db.Query(query, userId)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apiKeys := []*shared.ApiKey{}
+	for rows.Next() {
+		apiKey, err := scanApiKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	if err := ps.loadApiKeyServiceScopes(apiKeys); err != nil {
+		return nil, err
+	}
+
+	return apiKeys, nil
+}
+
+func (ps *PostgresStore) RevokeApiKey(userId uuid.UUID, apiKeyId uuid.UUID) error {
+	query := `UPDATE api_keys SET revoked_at = $3 WHERE user_id = $1 AND api_key_id = $2 AND revoked_at IS NULL`
+	result, err := ps.db.Exec(query, userId, apiKeyId, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowAffected == 0 {
+		return ErrApiKeyNotFound
+	}
+	return nil
+}
+
+// RotateApiKey stores replacement under the old key's name, budget and scope,
+// and shortens the old key's life to graceUntil so both keys work until then.
+// The replacement joins the old key's lineage, so both spend one budget.
+// The old key must belong to replacement.UserId and still be active.
+func (ps *PostgresStore) RotateApiKey(oldKeyId uuid.UUID, replacement *shared.ApiKey, graceUntil time.Time) error {
 	tx, err := ps.db.Begin()
 	if err != nil {
 		return err
@@ -456,16 +1030,103 @@ func (ps *PostgresStore) CreateApiKey(apiKey *shared.ApiKey) error {
 
 	defer tx.Rollback()
 
-	queryApiKey := `
-		INSERT INTO api_keys(api_key, user_id, name, created_at)
-		VALUES ($1, $2, $3, $4)
+	now := time.Now().UTC()
+
+	queryOld := `
+		UPDATE api_keys SET expires_at = LEAST(COALESCE(expires_at, $3), $3)
+		WHERE user_id = $1
+			AND api_key_id = $2
+			AND revoked_at IS NULL
+			AND (expires_at IS NULL OR expires_at > $4)
+		RETURNING lineage_id, name, hard_cap, daily_limit, weekly_limit, monthly_limit, max_call_cost, allowed_methods, member_id
+	`
+	var lineageId uuid.UUID
+	err = tx.QueryRow(queryOld, replacement.UserId, oldKeyId, graceUntil, now).Scan(
+		&lineageId,
+		&replacement.Name,
+		&replacement.Budget.HardCap,
+		&replacement.Budget.DailyLimit,
+		&replacement.Budget.WeeklyLimit,
+		&replacement.Budget.MonthlyLimit,
+		&replacement.Scope.MaxCallCost,
+		pq.Array(&replacement.Scope.AllowedMethods),
+		&replacement.MemberId,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrApiKeyNotFound
+		}
+		return err
+	}
+
+	if err := insertApiKey(tx, replacement, lineageId); err != nil {
+		return err
+	}
+
+	queryScopes := `
+		INSERT INTO api_key_scopes (api_key_id, provider, service)
+		SELECT $1, provider, service FROM api_key_scopes WHERE api_key_id = $2
 	`
+	if _, err := tx.Exec(queryScopes, replacement.ApiKeyId, oldKeyId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
 
-	_, err = tx.Exec(queryApiKey, apiKey.ApiKey, apiKey.UserId, apiKey.Name, apiKey.CreatedAt)
+const apiKeyColumns = `api_key, api_key_id, user_id, name, prefix_hint, last_used_at, expires_at, revoked_at,
+	hard_cap, daily_limit, weekly_limit, monthly_limit, max_call_cost, allowed_methods, member_id, created_at`
+
+func scanApiKey(row rowScanner) (*shared.ApiKey, error) {
+	apiKey := new(shared.ApiKey)
+	err := row.Scan(
+		&apiKey.ApiKey,
+		&apiKey.ApiKeyId,
+		&apiKey.UserId,
+		&apiKey.Name,
+		&apiKey.PrefixHint,
+		&apiKey.LastUsedAt,
+		&apiKey.ExpiresAt,
+		&apiKey.RevokedAt,
+		&apiKey.Budget.HardCap,
+		&apiKey.Budget.DailyLimit,
+		&apiKey.Budget.WeeklyLimit,
+		&apiKey.Budget.MonthlyLimit,
+		&apiKey.Scope.MaxCallCost,
+		pq.Array(&apiKey.Scope.AllowedMethods),
+		&apiKey.MemberId,
+		&apiKey.CreatedAt,
+	)
+	return apiKey, err
+}
 
+func (ps *PostgresStore) CreateApiKey(apiKey *shared.ApiKey) error {
+	tx, err := ps.db.Begin()
 	if err != nil {
 		return err
 	}
 
+	defer tx.Rollback()
+
+	if err := insertApiKey(tx, apiKey, apiKey.ApiKeyId); err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
+
+// insertApiKey stores a key in lineageId's lineage: its own for a new key,
+// its predecessor's for a rotated one.
+func insertApiKey(tx *sql.Tx, apiKey *shared.ApiKey, lineageId uuid.UUID) error {
+	queryApiKey := `
+		INSERT INTO api_keys(api_key, api_key_id, lineage_id, user_id, name, prefix_hint, expires_at, hard_cap, daily_limit, weekly_limit, monthly_limit, max_call_cost, allowed_methods, member_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+	`
+
+	_, err := tx.Exec(queryApiKey, apiKey.ApiKey, apiKey.ApiKeyId, lineageId, apiKey.UserId, apiKey.Name, apiKey.PrefixHint, apiKey.ExpiresAt, apiKey.Budget.HardCap, apiKey.Budget.DailyLimit, apiKey.Budget.WeeklyLimit, apiKey.Budget.MonthlyLimit, apiKey.Scope.MaxCallCost, pq.Array(apiKey.Scope.AllowedMethods), apiKey.MemberId, apiKey.CreatedAt)
+	return err
+}
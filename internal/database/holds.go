@@ -0,0 +1,324 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+var ErrHoldNotFound = errors.New("hold not found")
+var ErrHoldClosed = errors.New("hold is already captured or voided")
+var ErrHoldNotCaptured = errors.New("hold has not been captured")
+var ErrCaptureExceedsCap = errors.New("capture amount exceeds hold cap")
+var ErrInvalidCaptureAmount = errors.New("capture amount must not be negative")
+
+func (ps *PostgresStore) createHoldTable() error {
+	query := `CREATE TABLE IF NOT EXISTS holds (
+        transaction_id UUID PRIMARY KEY,
+        user_id UUID NOT NULL,
+        amount BIGINT NOT NULL CHECK (amount > 0),
+        max_amount BIGINT NOT NULL,
+        captured_amount BIGINT NOT NULL DEFAULT 0,
+        status VARCHAR(20) NOT NULL CHECK (status IN ('AUTHORIZED', 'CAPTURED', 'VOIDED')) DEFAULT 'AUTHORIZED',
+        shard INT,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        CHECK (max_amount >= amount),
+        CONSTRAINT fk_hold_transaction
+            FOREIGN KEY (transaction_id)
+                REFERENCES transactions(transaction_id)
+                    ON DELETE RESTRICT,
+        CONSTRAINT fk_hold_user
+            FOREIGN KEY (user_id)
+                REFERENCES users(user_id)
+                    ON DELETE RESTRICT
+    )`
+	if _, err := ps.db.Exec(query); err != nil {
+		return err
+	}
+
+	return ps.addColumn("holds", "shard INT")
+}
+
+// Authorize reserves transaction.Amount by moving it from the available
+// balance to the held balance, on a shard of a sharded wallet. The CHARGE
+// transaction stays PENDING until the hold is captured or voided. maxAmount
+// caps what Capture may later take and is raised to the reserved amount if
+// lower.
+func (ps *PostgresStore) Authorize(transaction *shared.Transaction, maxAmount int64) (*shared.Hold, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	if transaction.Amount <= 0 {
+		return nil, ErrAmountNotGreaterThanZero
+	}
+
+	if maxAmount < transaction.Amount {
+		maxAmount = transaction.Amount
+	}
+
+	requestHash := requestFingerprint("HOLD", transaction.Amount, maxAmount, transaction.ApiKeyId, transaction.ProviderId)
+
+	queryTransaction := `
+		INSERT INTO transactions (transaction_id, user_id, idempotency_key, request_hash, amount, type, api_key_id, provider_id, member_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (user_id, idempotency_key) WHERE idempotency_expired_at IS NULL DO NOTHING
+	`
+
+	result, err := tx.Exec(queryTransaction, transaction.TransactionId, transaction.UserId, transaction.IdempotencyKey, requestHash, transaction.Amount, transaction.Type, transaction.ApiKeyId, transaction.ProviderId, transaction.MemberId, transaction.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowAffected == 0 {
+		oldTransaction, err := readIdempotentTransaction(tx, transaction.UserId, transaction.IdempotencyKey, requestHash)
+		if err != nil {
+			return nil, err
+		}
+		queryRead := `
+			SELECT transaction_id, user_id, amount, max_amount, captured_amount, status, created_at, updated_at
+			FROM holds
+			WHERE transaction_id = $1
+		`
+		return scanHold(tx.QueryRow(queryRead, oldTransaction.TransactionId))
+	}
+
+	budget, err := lockApiKeyBudget(tx, transaction.ApiKeyId)
+	if err != nil {
+		return nil, err
+	}
+
+	shard, err := ps.reserveWallet(tx, transaction.UserId, transaction.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	hold := &shared.Hold{
+		TransactionId: transaction.TransactionId,
+		UserId:        transaction.UserId,
+		Amount:        transaction.Amount,
+		MaxAmount:     maxAmount,
+		Status:        "AUTHORIZED",
+		CreatedAt:     transaction.CreatedAt,
+		UpdatedAt:     transaction.CreatedAt,
+	}
+
+	queryHold := `
+		INSERT INTO holds (transaction_id, user_id, amount, max_amount, status, shard, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err = tx.Exec(queryHold, hold.TransactionId, hold.UserId, hold.Amount, hold.MaxAmount, hold.Status, shard, hold.CreatedAt, hold.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkApiKeyBudget(tx, budget); err != nil {
+		return nil, err
+	}
+
+	if err := checkWalletLimits(tx, transaction.UserId); err != nil {
+		return nil, err
+	}
+
+	transaction.Status = "PENDING"
+
+	return hold, tx.Commit()
+}
+
+// Capture settles a hold for the actual amount. Anything below the reserved
+// amount goes back to the available balance; anything above it, up to the
+// cap, is taken from the available balance, preferably from the row the hold
+// was reserved on, and fails with ErrInsufficientFunds if the wallet cannot
+// cover it, or ErrBudgetExceeded if the API key's budget cannot. Capturing
+// again with the same amount returns the captured hold.
+func (ps *PostgresStore) Capture(transactionId uuid.UUID, amount int64) (*shared.Hold, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	if amount < 0 {
+		return nil, ErrInvalidCaptureAmount
+	}
+
+	hold, err := lockHold(tx, transactionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if hold.Status == "CAPTURED" && hold.CapturedAmount == amount {
+		return hold, nil
+	}
+	if hold.Status != "AUTHORIZED" {
+		return nil, ErrHoldClosed
+	}
+	if amount > hold.MaxAmount {
+		return nil, ErrCaptureExceedsCap
+	}
+
+	var apiKeyId, providerId *uuid.UUID
+	err = tx.QueryRow(`SELECT api_key_id, provider_id FROM transactions WHERE transaction_id = $1`, transactionId).Scan(&apiKeyId, &providerId)
+	if err != nil {
+		return nil, err
+	}
+
+	budget, err := lockApiKeyBudget(tx, apiKeyId)
+	if err != nil {
+		return nil, err
+	}
+
+	shard, err := reservedShard(tx, transactionId)
+	if err != nil {
+		return nil, err
+	}
+
+	extra := amount - hold.Amount
+	if err := ps.settleReservation(tx, hold.UserId, shard, hold.Amount, extra); err != nil {
+		return nil, err
+	}
+
+	hold.Status = "CAPTURED"
+	hold.CapturedAmount = amount
+	hold.UpdatedAt = time.Now().UTC()
+
+	if err := closeHold(tx, hold, "SUCCEEDED", amount); err != nil {
+		return nil, err
+	}
+
+	// Authorizing only reserves money inside the wallet; it leaves the wallet
+	// when the hold is captured.
+	if amount > 0 {
+		walletId, err := walletAccountId(tx, hold.UserId)
+		if err != nil {
+			return nil, err
+		}
+		creditId, err := chargeAccountId(tx, providerId)
+		if err != nil {
+			return nil, err
+		}
+		if err := postMovement(tx, &hold.TransactionId, "CHARGE", walletId, creditId, amount); err != nil {
+			return nil, err
+		}
+	}
+
+	if extra > 0 {
+		if err := checkApiKeyBudget(tx, budget); err != nil {
+			return nil, err
+		}
+		if err := checkWalletLimits(tx, hold.UserId); err != nil {
+			return nil, err
+		}
+	}
+
+	return hold, tx.Commit()
+}
+
+// Void releases a hold in full and marks its CHARGE transaction FAILED.
+// Voiding an already voided hold is a no-op.
+func (ps *PostgresStore) Void(transactionId uuid.UUID) (*shared.Hold, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	hold, err := lockHold(tx, transactionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if hold.Status == "VOIDED" {
+		return hold, nil
+	}
+	if hold.Status != "AUTHORIZED" {
+		return nil, ErrHoldClosed
+	}
+
+	shard, err := reservedShard(tx, transactionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := releaseReservation(tx, hold.UserId, shard, hold.Amount); err != nil {
+		return nil, err
+	}
+
+	hold.Status = "VOIDED"
+	hold.UpdatedAt = time.Now().UTC()
+
+	if err := closeHold(tx, hold, "FAILED", hold.Amount); err != nil {
+		return nil, err
+	}
+
+	return hold, tx.Commit()
+}
+
+func (ps *PostgresStore) GetHoldById(transactionId uuid.UUID) (*shared.Hold, error) {
+	queryHold := `
+		SELECT transaction_id, user_id, amount, max_amount, captured_amount, status, created_at, updated_at
+		FROM holds
+		WHERE transaction_id = $1
+	`
+	return scanHold(ps.db.QueryRow(queryHold, transactionId))
+}
+
+func lockHold(tx *sql.Tx, transactionId uuid.UUID) (*shared.Hold, error) {
+	queryHold := `
+		SELECT transaction_id, user_id, amount, max_amount, captured_amount, status, created_at, updated_at
+		FROM holds
+		WHERE transaction_id = $1
+		FOR UPDATE
+	`
+	return scanHold(tx.QueryRow(queryHold, transactionId))
+}
+
+// reservedShard returns the shard a hold's money is reserved on, or nil for
+// the main balance row.
+func reservedShard(tx *sql.Tx, transactionId uuid.UUID) (*int, error) {
+	var shard *int
+	err := tx.QueryRow(`SELECT shard FROM holds WHERE transaction_id = $1`, transactionId).Scan(&shard)
+	return shard, err
+}
+
+func closeHold(tx *sql.Tx, hold *shared.Hold, transactionStatus string, transactionAmount int64) error {
+	queryHold := `UPDATE holds SET status = $1, captured_amount = $2, updated_at = $3 WHERE transaction_id = $4`
+	if _, err := tx.Exec(queryHold, hold.Status, hold.CapturedAmount, hold.UpdatedAt, hold.TransactionId); err != nil {
+		return err
+	}
+
+	queryTransaction := `UPDATE transactions SET status = $1, amount = $2 WHERE transaction_id = $3`
+	_, err := tx.Exec(queryTransaction, transactionStatus, transactionAmount, hold.TransactionId)
+	return err
+}
+
+func scanHold(row *sql.Row) (*shared.Hold, error) {
+	hold := new(shared.Hold)
+	err := row.Scan(
+		&hold.TransactionId,
+		&hold.UserId,
+		&hold.Amount,
+		&hold.MaxAmount,
+		&hold.CapturedAmount,
+		&hold.Status,
+		&hold.CreatedAt,
+		&hold.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrHoldNotFound
+	}
+	return hold, err
+}
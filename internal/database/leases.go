@@ -0,0 +1,399 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+// A balance lease reserves part of a wallet's balance for one server process,
+// which then charges against it in memory and records the charges later. The
+// leased amount leaves the available balance when the lease is taken and is
+// tracked in balances.leased, so whatever the process does with it, the
+// wallet cannot be overspent. Flushing a lease records its charges and moves
+// their total out of leased; releasing it also returns the unspent rest.
+//
+// A lease that is not renewed by its expiry is marked EXPIRED by
+// ExpireLeases, but its unspent rest is not handed back: the process holding
+// it may have acknowledged charges it has not recorded yet. The rest stays in
+// leased, out of the wallet's reach. If the process is still alive, for
+// example after a database outage, it records those charges late and
+// releases the lease as usual. If it crashed, reconciliation reports the
+// lease, and an operator who has accounted for its charges hands the rest
+// back with ReleaseExpiredLease.
+
+var ErrLeaseNotAllowed = errors.New("wallet cannot be leased")
+var ErrLeaseExpired = errors.New("balance lease expired")
+var ErrLeaseClosed = errors.New("balance lease is already released")
+var ErrLeaseNotExpired = errors.New("balance lease has not expired")
+var ErrLeaseNotFound = errors.New("balance lease not found")
+var ErrDuplicateCharge = errors.New("charge was already recorded under its idempotency key")
+
+func (ps *PostgresStore) createBalanceLeaseTable() error {
+	query := `CREATE TABLE IF NOT EXISTS balance_leases (
+        lease_id UUID PRIMARY KEY,
+        user_id UUID NOT NULL,
+        amount BIGINT NOT NULL CHECK (amount > 0),
+        consumed BIGINT NOT NULL DEFAULT 0,
+        status VARCHAR(20) NOT NULL CHECK (status IN ('ACTIVE', 'RELEASED', 'EXPIRED')) DEFAULT 'ACTIVE',
+        expires_at TIMESTAMP NOT NULL,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        CHECK (consumed >= 0 AND consumed <= amount),
+        CONSTRAINT fk_lease_balance
+            FOREIGN KEY (user_id)
+                REFERENCES balances(user_id)
+                    ON DELETE RESTRICT
+    );
+
+    CREATE INDEX IF NOT EXISTS balance_leases_active_idx ON balance_leases (expires_at) WHERE status = 'ACTIVE'`
+	_, err := ps.db.Exec(query)
+	return err
+}
+
+// AcquireLease leases up to want from the wallet's available balance, but no
+// less than least, or fails with ErrInsufficientFunds. Wallets with spending
+// limits cannot be leased, since charges against a lease are not checked
+// against them.
+func (ps *PostgresStore) AcquireLease(userId uuid.UUID, want int64, least int64, expiresAt time.Time) (*shared.BalanceLease, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	if least <= 0 || want < least {
+		return nil, ErrAmountNotGreaterThanZero
+	}
+
+	var limited bool
+	queryLimits := `
+		SELECT EXISTS (
+			SELECT 1 FROM sub_wallets
+			WHERE wallet_id = $1
+				AND (hard_cap IS NOT NULL OR daily_limit IS NOT NULL OR weekly_limit IS NOT NULL OR monthly_limit IS NOT NULL)
+		)
+	`
+	if err := tx.QueryRow(queryLimits, userId).Scan(&limited); err != nil {
+		return nil, err
+	}
+	if limited {
+		return nil, ErrLeaseNotAllowed
+	}
+
+	var balance int64
+	queryRead := `SELECT balance FROM balances WHERE user_id = $1 FOR UPDATE`
+
+	err = tx.QueryRow(queryRead, userId).Scan(&balance)
+	if err != nil {
+		return nil, err
+	}
+
+	if balance < want {
+		balance, err = gatherShards(tx, userId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if balance < least {
+		return nil, ErrInsufficientFunds
+	}
+
+	now := time.Now().UTC()
+	lease := &shared.BalanceLease{
+		LeaseId:   uuid.New(),
+		UserId:    userId,
+		Amount:    min(want, balance),
+		Status:    "ACTIVE",
+		ExpiresAt: expiresAt,
+		CreatedAt: now,
+	}
+
+	queryUpdate := `
+        UPDATE balances 
+        SET balance = balance - $1, leased = leased + $1
+        WHERE user_id = $2
+    `
+	if _, err := tx.Exec(queryUpdate, lease.Amount, userId); err != nil {
+		return nil, err
+	}
+
+	queryLease := `
+		INSERT INTO balance_leases (lease_id, user_id, amount, status, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)
+	`
+	if _, err := tx.Exec(queryLease, lease.LeaseId, lease.UserId, lease.Amount, lease.Status, lease.ExpiresAt, lease.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return lease, tx.Commit()
+}
+
+// FlushLease records charges made against an active lease and extends it to
+// renewUntil. A charge whose idempotency key was already used is not
+// recorded and is reported as ErrDuplicateCharge, so its amount stays in the
+// lease. A lease that has expired fails with ErrLeaseExpired and records
+// nothing; its charges can still be recorded by ReleaseLease.
+func (ps *PostgresStore) FlushLease(leaseId uuid.UUID, charges []*shared.Transaction, renewUntil time.Time) ([]error, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	lease, err := lockLease(tx, leaseId)
+	if err != nil {
+		return nil, err
+	}
+	if lease.Status == "RELEASED" {
+		return nil, ErrLeaseClosed
+	}
+	if lease.Status != "ACTIVE" || !lease.ExpiresAt.After(time.Now().UTC()) {
+		return nil, ErrLeaseExpired
+	}
+
+	errs, err := flushLease(tx, lease, charges)
+	if err != nil {
+		return nil, err
+	}
+
+	queryRenew := `UPDATE balance_leases SET expires_at = $2, updated_at = $3 WHERE lease_id = $1`
+	if _, err := tx.Exec(queryRenew, lease.LeaseId, renewUntil, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	return errs, tx.Commit()
+}
+
+// ReleaseLease records the lease's last charges like FlushLease, then closes
+// it and returns what was not spent to the wallet. Only the process holding
+// the lease releases it this way, so it also takes a lease that has expired
+// and records the charges that were waiting on it.
+func (ps *PostgresStore) ReleaseLease(leaseId uuid.UUID, charges []*shared.Transaction) ([]error, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	lease, err := lockLease(tx, leaseId)
+	if err != nil {
+		return nil, err
+	}
+	if lease.Status == "RELEASED" {
+		return nil, ErrLeaseClosed
+	}
+
+	errs, err := flushLease(tx, lease, charges)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := closeLease(tx, lease, "RELEASED"); err != nil {
+		return nil, err
+	}
+
+	return errs, tx.Commit()
+}
+
+// ExpireLeases marks every active lease that expired before the given time
+// EXPIRED, typically because the process holding it died, and returns how
+// many it marked. Their unspent rest stays leased.
+func (ps *PostgresStore) ExpireLeases(before time.Time) (int64, error) {
+	query := `
+		UPDATE balance_leases SET status = 'EXPIRED', updated_at = $2
+		WHERE status = 'ACTIVE' AND expires_at < $1
+	`
+	result, err := ps.db.Exec(query, before, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ReleaseExpiredLease hands the unspent rest of an expired lease back to the
+// wallet, once an operator has accounted for the charges its process may
+// have made against it.
+func (ps *PostgresStore) ReleaseExpiredLease(leaseId uuid.UUID) (*shared.BalanceLease, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	lease, err := lockLease(tx, leaseId)
+	if err != nil {
+		return nil, err
+	}
+	if lease.Status == "RELEASED" {
+		return nil, ErrLeaseClosed
+	}
+	if lease.Status != "EXPIRED" {
+		return nil, ErrLeaseNotExpired
+	}
+
+	if err := closeLease(tx, lease, "RELEASED"); err != nil {
+		return nil, err
+	}
+	lease.Status = "RELEASED"
+
+	return lease, tx.Commit()
+}
+
+// flushLease records charges against a locked lease the way Charge does,
+// each under its own savepoint so that a duplicate does not undo the others.
+func flushLease(tx *sql.Tx, lease *shared.BalanceLease, charges []*shared.Transaction) ([]error, error) {
+	errs := make([]error, len(charges))
+	if len(charges) == 0 {
+		return errs, nil
+	}
+
+	walletId, err := walletAccountId(tx, lease.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	var consumed int64
+	for i, charge := range charges {
+		if _, err := tx.Exec(`SAVEPOINT lease_charge`); err != nil {
+			return nil, err
+		}
+
+		recorded, err := recordLeasedCharge(tx, charge, walletId)
+		if err != nil {
+			if _, err := tx.Exec(`ROLLBACK TO SAVEPOINT lease_charge`); err != nil {
+				return nil, err
+			}
+			errs[i] = err
+			continue
+		}
+		if !recorded {
+			errs[i] = ErrDuplicateCharge
+		} else {
+			consumed += charge.Amount
+		}
+
+		if _, err := tx.Exec(`RELEASE SAVEPOINT lease_charge`); err != nil {
+			return nil, err
+		}
+	}
+
+	if lease.Consumed+consumed > lease.Amount {
+		// The process spent more than it leased; refuse to record any of it.
+		return nil, ErrInsufficientFunds
+	}
+
+	queryLease := `UPDATE balance_leases SET consumed = consumed + $2 WHERE lease_id = $1`
+	if _, err := tx.Exec(queryLease, lease.LeaseId, consumed); err != nil {
+		return nil, err
+	}
+
+	queryBalance := `UPDATE balances SET leased = leased - $2 WHERE user_id = $1`
+	if _, err := tx.Exec(queryBalance, lease.UserId, consumed); err != nil {
+		return nil, err
+	}
+
+	lease.Consumed += consumed
+	return errs, nil
+}
+
+// GetIdempotentTransactions returns the user's transactions whose idempotency
+// keys have not expired, by key.
+func (ps *PostgresStore) GetIdempotentTransactions(userId uuid.UUID) (map[string]*shared.Transaction, error) {
+	query := `
+		SELECT transaction_id, user_id, idempotency_key, amount, type, status, status_reason, parent_transaction_id, api_key_id, provider_id, counterparty_id, member_id, created_at
+		FROM transactions
+		WHERE user_id = $1 AND idempotency_expired_at IS NULL
+	`
+	rows, err := ps.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := make(map[string]*shared.Transaction)
+	for rows.Next() {
+		transaction, err := scanIntoTransactions(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions[transaction.IdempotencyKey] = transaction
+	}
+
+	return transactions, rows.Err()
+}
+
+// recordLeasedCharge stores a charge paid from a lease and posts it to the
+// ledger. It reports false if the idempotency key was already taken.
+func recordLeasedCharge(tx *sql.Tx, charge *shared.Transaction, walletId uuid.UUID) (bool, error) {
+	requestHash := requestFingerprint(charge.Type, charge.Amount, charge.ApiKeyId, charge.ProviderId)
+
+	queryTransaction := `
+		INSERT INTO transactions (transaction_id, user_id, idempotency_key, request_hash, amount, type, api_key_id, provider_id, member_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (user_id, idempotency_key) WHERE idempotency_expired_at IS NULL DO NOTHING
+	`
+
+	result, err := tx.Exec(queryTransaction, charge.TransactionId, charge.UserId, charge.IdempotencyKey, requestHash, charge.Amount, charge.Type, charge.ApiKeyId, charge.ProviderId, charge.MemberId, charge.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rowAffected == 0 {
+		return false, nil
+	}
+
+	creditId, err := chargeAccountId(tx, charge.ProviderId)
+	if err != nil {
+		return false, err
+	}
+	if err := postMovement(tx, &charge.TransactionId, "CHARGE", walletId, creditId, charge.Amount); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// closeLease returns the unspent part of a lease to the wallet and records
+// the lease's final status.
+func closeLease(tx *sql.Tx, lease *shared.BalanceLease, status string) error {
+	unspent := lease.Amount - lease.Consumed
+
+	queryBalance := `
+        UPDATE balances 
+        SET balance = balance + $1, leased = leased - $1
+        WHERE user_id = $2
+    `
+	if _, err := tx.Exec(queryBalance, unspent, lease.UserId); err != nil {
+		return err
+	}
+
+	queryLease := `UPDATE balance_leases SET status = $2, updated_at = $3 WHERE lease_id = $1`
+	_, err := tx.Exec(queryLease, lease.LeaseId, status, time.Now().UTC())
+	return err
+}
+
+func lockLease(tx *sql.Tx, leaseId uuid.UUID) (*shared.BalanceLease, error) {
+	query := `
+		SELECT lease_id, user_id, amount, consumed, status, expires_at, created_at
+		FROM balance_leases
+		WHERE lease_id = $1
+		FOR UPDATE
+	`
+	lease := new(shared.BalanceLease)
+	err := tx.QueryRow(query, leaseId).Scan(&lease.LeaseId, &lease.UserId, &lease.Amount, &lease.Consumed, &lease.Status, &lease.ExpiresAt, &lease.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrLeaseNotFound
+	}
+	return lease, err
+}
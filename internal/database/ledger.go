@@ -0,0 +1,349 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+// The ledger records every movement of money as a journal entry whose legs
+// sum to zero. A leg's amount is positive when it credits the account, that
+// is when it increases what the account holds, and negative when it debits
+// it. A user's wallet account therefore always sums to the user's balance
+// plus what is held for open authorizations and what is leased and not yet
+// spent.
+//
+// Besides one wallet per user there is one account of each system type:
+// PLATFORM_REVENUE earns direct charges, PROVIDER_PAYABLE accrues what agents
+// were billed for calls proxied to upstream providers, PROMO issues
+// promotional credit and FUNDING is where deposited money comes from.
+
+var ErrUnbalancedEntry = errors.New("journal entry does not balance")
+var ErrAccountNotFound = errors.New("ledger account not found")
+
+var systemAccountTypes = []string{"PLATFORM_REVENUE", "PROVIDER_PAYABLE", "PROMO", "FUNDING"}
+
+type journalLeg struct {
+	accountId uuid.UUID
+	amount    int64
+}
+
+func (ps *PostgresStore) createLedgerAccountTable() error {
+	query := `CREATE TABLE IF NOT EXISTS ledger_accounts (
+        account_id UUID PRIMARY KEY,
+        type VARCHAR(20) NOT NULL CHECK (type IN ('USER_WALLET', 'PLATFORM_REVENUE', 'PROVIDER_PAYABLE', 'PROMO', 'FUNDING')),
+        user_id UUID UNIQUE,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+        CHECK ((type = 'USER_WALLET') = (user_id IS NOT NULL)),
+        CONSTRAINT fk_account_user
+            FOREIGN KEY (user_id)
+                REFERENCES users(user_id)
+                    ON DELETE RESTRICT
+    )`
+	if _, err := ps.db.Exec(query); err != nil {
+		return err
+	}
+
+	queryIndex := `CREATE UNIQUE INDEX IF NOT EXISTS ledger_accounts_system_type_idx
+        ON ledger_accounts (type)
+        WHERE user_id IS NULL`
+	if _, err := ps.db.Exec(queryIndex); err != nil {
+		return err
+	}
+
+	for _, accountType := range systemAccountTypes {
+		querySeed := `
+			INSERT INTO ledger_accounts (account_id, type, created_at)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (type) WHERE user_id IS NULL DO NOTHING
+		`
+		if _, err := ps.db.Exec(querySeed, uuid.New(), accountType, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createJournalTables creates the journal and the triggers that keep it
+// append-only and reject, at commit, any entry whose legs do not sum to zero.
+func (ps *PostgresStore) createJournalTables() error {
+	query := `CREATE TABLE IF NOT EXISTS journal_entries (
+        entry_id UUID PRIMARY KEY,
+        transaction_id UUID,
+        kind VARCHAR(20) NOT NULL CHECK (kind IN ('DEPOSIT', 'PROMO', 'CHARGE', 'REFUND', 'TRANSFER', 'OPENING_BALANCE')),
+        created_at TIMESTAMP NOT NULL,
+
+        CONSTRAINT fk_entry_transaction
+            FOREIGN KEY (transaction_id)
+                REFERENCES transactions(transaction_id)
+                    ON DELETE RESTRICT
+    );
+
+    CREATE TABLE IF NOT EXISTS journal_legs (
+        leg_id BIGSERIAL PRIMARY KEY,
+        entry_id UUID NOT NULL,
+        account_id UUID NOT NULL,
+        amount BIGINT NOT NULL CHECK (amount <> 0),
+
+        CONSTRAINT fk_leg_entry
+            FOREIGN KEY (entry_id)
+                REFERENCES journal_entries(entry_id)
+                    ON DELETE RESTRICT,
+        CONSTRAINT fk_leg_account
+            FOREIGN KEY (account_id)
+                REFERENCES ledger_accounts(account_id)
+                    ON DELETE RESTRICT
+    );
+
+    CREATE INDEX IF NOT EXISTS journal_entries_transaction_idx ON journal_entries (transaction_id);
+    CREATE INDEX IF NOT EXISTS journal_legs_entry_idx ON journal_legs (entry_id);
+    CREATE INDEX IF NOT EXISTS journal_legs_account_idx ON journal_legs (account_id);
+
+    CREATE OR REPLACE FUNCTION forbid_journal_changes() RETURNS trigger AS $$
+    BEGIN
+        RAISE EXCEPTION 'journal is append-only';
+    END;
+    $$ LANGUAGE plpgsql;
+
+    CREATE OR REPLACE FUNCTION check_journal_entry_balanced() RETURNS trigger AS $$
+    BEGIN
+        IF (SELECT SUM(amount) FROM journal_legs WHERE entry_id = NEW.entry_id) <> 0 THEN
+            RAISE EXCEPTION 'journal entry % does not balance', NEW.entry_id;
+        END IF;
+        RETURN NULL;
+    END;
+    $$ LANGUAGE plpgsql;
+
+    DROP TRIGGER IF EXISTS journal_entries_append_only ON journal_entries;
+    CREATE TRIGGER journal_entries_append_only
+        BEFORE UPDATE OR DELETE ON journal_entries
+        FOR EACH ROW EXECUTE FUNCTION forbid_journal_changes();
+
+    DROP TRIGGER IF EXISTS journal_legs_append_only ON journal_legs;
+    CREATE TRIGGER journal_legs_append_only
+        BEFORE UPDATE OR DELETE ON journal_legs
+        FOR EACH ROW EXECUTE FUNCTION forbid_journal_changes();
+
+    DROP TRIGGER IF EXISTS journal_legs_balanced ON journal_legs;
+    CREATE CONSTRAINT TRIGGER journal_legs_balanced
+        AFTER INSERT ON journal_legs
+        DEFERRABLE INITIALLY DEFERRED
+        FOR EACH ROW EXECUTE FUNCTION check_journal_entry_balanced();`
+	if _, err := ps.db.Exec(query); err != nil {
+		return err
+	}
+
+	return ps.widenCheck("journal_entries", "journal_entries_kind_check", "TRANSFER", "kind IN ('DEPOSIT', 'PROMO', 'CHARGE', 'REFUND', 'TRANSFER', 'OPENING_BALANCE')")
+}
+
+// backfillWalletAccounts opens a wallet account for every user that predates
+// the ledger, with an opening entry for the money the user already has.
+func (ps *PostgresStore) backfillWalletAccounts() error {
+	rows, err := ps.db.Query(`
+		SELECT b.user_id
+		FROM balances b
+		LEFT JOIN ledger_accounts a ON a.user_id = b.user_id
+		WHERE a.account_id IS NULL
+	`)
+	if err != nil {
+		return err
+	}
+
+	userIds := []uuid.UUID{}
+	for rows.Next() {
+		var userId uuid.UUID
+		if err := rows.Scan(&userId); err != nil {
+			rows.Close()
+			return err
+		}
+		userIds = append(userIds, userId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, userId := range userIds {
+		if err := ps.openWalletWithBalance(userId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps *PostgresStore) openWalletWithBalance(userId uuid.UUID) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var total int64
+	queryRead := `SELECT ` + availableBalance + ` + ` + heldBalance + ` + b.leased FROM balances b WHERE b.user_id = $1 FOR UPDATE`
+	if err := tx.QueryRow(queryRead, userId).Scan(&total); err != nil {
+		return err
+	}
+
+	walletId := uuid.New()
+	queryAccount := `
+		INSERT INTO ledger_accounts (account_id, type, user_id, created_at)
+		VALUES ($1, 'USER_WALLET', $2, $3)
+		ON CONFLICT (user_id) DO NOTHING
+	`
+	result, err := tx.Exec(queryAccount, walletId, userId, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		// Another instance opened it first.
+		return err
+	}
+
+	if total != 0 {
+		fundingId, err := systemAccountId(tx, "FUNDING")
+		if err != nil {
+			return err
+		}
+		if err := postMovement(tx, nil, "OPENING_BALANCE", fundingId, walletId, total); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func createWalletAccount(tx *sql.Tx, userId uuid.UUID, createdAt time.Time) error {
+	query := `
+		INSERT INTO ledger_accounts (account_id, type, user_id, created_at)
+		VALUES ($1, 'USER_WALLET', $2, $3)
+	`
+	_, err := tx.Exec(query, uuid.New(), userId, createdAt)
+	return err
+}
+
+func walletAccountId(tx *sql.Tx, userId uuid.UUID) (uuid.UUID, error) {
+	var accountId uuid.UUID
+	err := tx.QueryRow(`SELECT account_id FROM ledger_accounts WHERE user_id = $1`, userId).Scan(&accountId)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, ErrAccountNotFound
+	}
+	return accountId, err
+}
+
+func systemAccountId(tx *sql.Tx, accountType string) (uuid.UUID, error) {
+	var accountId uuid.UUID
+	err := tx.QueryRow(`SELECT account_id FROM ledger_accounts WHERE type = $1 AND user_id IS NULL`, accountType).Scan(&accountId)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, ErrAccountNotFound
+	}
+	return accountId, err
+}
+
+// chargeAccountId returns the account a charge is credited to: the provider
+// payable for proxied calls and platform revenue for everything else.
+func chargeAccountId(tx *sql.Tx, providerId *uuid.UUID) (uuid.UUID, error) {
+	if providerId != nil {
+		return systemAccountId(tx, "PROVIDER_PAYABLE")
+	}
+	return systemAccountId(tx, "PLATFORM_REVENUE")
+}
+
+// postMovement posts a two-legged entry moving amount from one account to
+// another.
+func postMovement(tx *sql.Tx, transactionId *uuid.UUID, kind string, from uuid.UUID, to uuid.UUID, amount int64) error {
+	return postJournalEntry(tx, transactionId, kind,
+		journalLeg{accountId: from, amount: -amount},
+		journalLeg{accountId: to, amount: amount},
+	)
+}
+
+func postJournalEntry(tx *sql.Tx, transactionId *uuid.UUID, kind string, legs ...journalLeg) error {
+	var sum int64
+	for _, leg := range legs {
+		if leg.amount == 0 {
+			return ErrUnbalancedEntry
+		}
+		sum += leg.amount
+	}
+	if len(legs) < 2 || sum != 0 {
+		return ErrUnbalancedEntry
+	}
+
+	entryId := uuid.New()
+	queryEntry := `
+		INSERT INTO journal_entries (entry_id, transaction_id, kind, created_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	if _, err := tx.Exec(queryEntry, entryId, transactionId, kind, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	queryLeg := `INSERT INTO journal_legs (entry_id, account_id, amount) VALUES ($1, $2, $3)`
+	for _, leg := range legs {
+		if _, err := tx.Exec(queryLeg, entryId, leg.accountId, leg.amount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetWalletLedger compares a user's stored balance with the sum of the
+// user's wallet account in the journal.
+func (ps *PostgresStore) GetWalletLedger(userId uuid.UUID) (*shared.WalletLedger, error) {
+	query := `
+		SELECT ` + availableBalance + `, ` + heldBalance + `, b.leased, a.account_id,
+			COALESCE((SELECT SUM(l.amount) FROM journal_legs l WHERE l.account_id = a.account_id), 0)
+		FROM balances b
+		JOIN ledger_accounts a ON a.user_id = b.user_id
+		WHERE b.user_id = $1
+	`
+	wallet := &shared.WalletLedger{UserId: userId}
+	err := ps.db.QueryRow(query, userId).Scan(&wallet.Balance, &wallet.Held, &wallet.Leased, &wallet.AccountId, &wallet.LedgerBalance)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAccountNotFound
+		}
+		return nil, err
+	}
+	wallet.Consistent = wallet.Balance+wallet.Held+wallet.Leased == wallet.LedgerBalance
+	return wallet, nil
+}
+
+func (ps *PostgresStore) GetJournalEntries(transactionId uuid.UUID) ([]*shared.JournalEntry, error) {
+	query := `
+		SELECT e.entry_id, e.transaction_id, e.kind, e.created_at, l.account_id, a.type, a.user_id, l.amount
+		FROM journal_entries e
+		JOIN journal_legs l ON l.entry_id = e.entry_id
+		JOIN ledger_accounts a ON a.account_id = l.account_id
+		WHERE e.transaction_id = $1
+		ORDER BY e.created_at, e.entry_id, l.leg_id
+	`
+	rows, err := ps.db.Query(query, transactionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*shared.JournalEntry{}
+	var current *shared.JournalEntry
+	for rows.Next() {
+		entry := &shared.JournalEntry{}
+		leg := shared.JournalLeg{}
+		err := rows.Scan(&entry.EntryId, &entry.TransactionId, &entry.Kind, &entry.CreatedAt, &leg.AccountId, &leg.AccountType, &leg.UserId, &leg.Amount)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil || current.EntryId != entry.EntryId {
+			current = entry
+			entries = append(entries, current)
+		}
+		current.Legs = append(current.Legs, leg)
+	}
+
+	return entries, rows.Err()
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Tables are created with their current columns by CREATE TABLE IF NOT
+// EXISTS, which leaves a table that already exists as it was. The helpers
+// below bring such a table up to date from Init. Each one reads the catalog
+// first, so a database that is already current is neither altered nor
+// locked.
+
+// addColumns adds the given column definitions that the table lacks.
+func (ps *PostgresStore) addColumns(table string, definitions ...string) error {
+	for _, definition := range definitions {
+		if err := ps.addColumn(table, definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds the column if the table lacks it, then runs backfill in the
+// same transaction to fill in the rows that predate it.
+func (ps *PostgresStore) addColumn(table string, definition string, backfill ...string) error {
+	column := strings.Fields(definition)[0]
+
+	var exists bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2
+		)
+	`
+	if err := ps.db.QueryRow(query, table, column).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s`, table, definition)); err != nil {
+		return fmt.Errorf("adding %s.%s: %w", table, column, err)
+	}
+	for _, statement := range backfill {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("backfilling %s.%s: %w", table, column, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// dropConstraint drops a constraint that an older schema had.
+func (ps *PostgresStore) dropConstraint(table string, constraint string) error {
+	_, err := ps.constraintDefinition(table, constraint)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = ps.db.Exec(fmt.Sprintf(`ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s`, table, constraint))
+	return err
+}
+
+// widenCheck replaces a CHECK constraint written before value was allowed
+// with check. A constraint that already allows value is left alone.
+func (ps *PostgresStore) widenCheck(table string, constraint string, value string, check string) error {
+	definition, err := ps.constraintDefinition(table, constraint)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && strings.Contains(definition, "'"+value+"'") {
+		return nil
+	}
+
+	query := fmt.Sprintf(`ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s, ADD CONSTRAINT %s CHECK (%s)`, table, constraint, constraint, check)
+	_, err = ps.db.Exec(query)
+	return err
+}
+
+func (ps *PostgresStore) constraintDefinition(table string, constraint string) (string, error) {
+	var definition string
+	query := `SELECT pg_get_constraintdef(oid) FROM pg_constraint WHERE conrelid = to_regclass($1) AND conname = $2`
+	err := ps.db.QueryRow(query, table, constraint).Scan(&definition)
+	return definition, err
+}
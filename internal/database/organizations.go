@@ -0,0 +1,269 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+// An organization is stored as a users row of kind ORGANIZATION, so it owns a
+// balance, a ledger wallet, transactions and API keys exactly like a user
+// does. Organizations cannot log in; members act on their behalf.
+
+var ErrOrganizationNotFound = errors.New("organization not found")
+var ErrNotMember = errors.New("user is not a member of the organization")
+var ErrAlreadyMember = errors.New("user is already a member of the organization")
+var ErrLastOwner = errors.New("an organization must keep at least one owner")
+
+func (ps *PostgresStore) createOrganizationMemberTable() error {
+	query := `CREATE TABLE IF NOT EXISTS organization_members (
+        org_id UUID NOT NULL,
+        user_id UUID NOT NULL,
+        role VARCHAR(20) NOT NULL CHECK (role IN ('OWNER', 'ADMIN', 'DEVELOPER', 'VIEWER')),
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (org_id, user_id),
+        CONSTRAINT fk_member_org
+            FOREIGN KEY (org_id)
+                REFERENCES users(user_id)
+                    ON DELETE CASCADE,
+        CONSTRAINT fk_member_user
+            FOREIGN KEY (user_id)
+                REFERENCES users(user_id)
+                    ON DELETE CASCADE
+    )`
+	_, err := ps.db.Exec(query)
+	return err
+}
+
+// CreateOrganization creates the organization with an empty wallet and makes
+// ownerId its first owner.
+func (ps *PostgresStore) CreateOrganization(org *shared.Organization, ownerId uuid.UUID) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	queryOrg := `
+		INSERT INTO users (user_id, username, email, password, kind, created_at)
+		VALUES ($1, $2, $3, '', 'ORGANIZATION', $4)
+	`
+	if _, err := tx.Exec(queryOrg, org.OrgId, org.Name, org.BillingEmail, org.CreatedAt); err != nil {
+		return err
+	}
+
+	queryBalance := `
+		INSERT INTO balances (user_id, balance, created_at)
+		VALUES ($1, $2, $3)
+	`
+	if _, err := tx.Exec(queryBalance, org.OrgId, 0, org.CreatedAt); err != nil {
+		return err
+	}
+
+	if err := createWalletAccount(tx, org.OrgId, org.CreatedAt); err != nil {
+		return err
+	}
+
+	queryMember := `
+		INSERT INTO organization_members (org_id, user_id, role, created_at)
+		VALUES ($1, $2, 'OWNER', $3)
+	`
+	if _, err := tx.Exec(queryMember, org.OrgId, ownerId, org.CreatedAt); err != nil {
+		return err
+	}
+
+	org.Role = "OWNER"
+
+	return tx.Commit()
+}
+
+// GetOrganization returns the organization with the role userId holds in it.
+func (ps *PostgresStore) GetOrganization(orgId uuid.UUID, userId uuid.UUID) (*shared.Organization, error) {
+	query := `
+		SELECT o.user_id, o.username, o.email, m.role, o.created_at
+		FROM users o
+		JOIN organization_members m ON m.org_id = o.user_id
+		WHERE o.user_id = $1 AND o.kind = 'ORGANIZATION' AND m.user_id = $2
+	`
+	org := &shared.Organization{}
+	err := ps.db.QueryRow(query, orgId, userId).Scan(&org.OrgId, &org.Name, &org.BillingEmail, &org.Role, &org.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrOrganizationNotFound
+	}
+	return org, err
+}
+
+func (ps *PostgresStore) GetOrganizationsByMember(userId uuid.UUID) ([]*shared.Organization, error) {
+	query := `
+		SELECT o.user_id, o.username, o.email, m.role, o.created_at
+		FROM users o
+		JOIN organization_members m ON m.org_id = o.user_id
+		WHERE o.kind = 'ORGANIZATION' AND m.user_id = $1
+		ORDER BY o.created_at
+	`
+	rows, err := ps.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []*shared.Organization{}
+	for rows.Next() {
+		org := &shared.Organization{}
+		if err := rows.Scan(&org.OrgId, &org.Name, &org.BillingEmail, &org.Role, &org.CreatedAt); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+
+	return orgs, rows.Err()
+}
+
+func (ps *PostgresStore) GetOrganizationMembers(orgId uuid.UUID) ([]*shared.OrganizationMember, error) {
+	query := `
+		SELECT m.user_id, u.username, m.role, m.created_at
+		FROM organization_members m
+		JOIN users u ON u.user_id = m.user_id
+		WHERE m.org_id = $1
+		ORDER BY m.created_at
+	`
+	rows, err := ps.db.Query(query, orgId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*shared.OrganizationMember{}
+	for rows.Next() {
+		member := &shared.OrganizationMember{}
+		if err := rows.Scan(&member.UserId, &member.Username, &member.Role, &member.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+func (ps *PostgresStore) AddOrganizationMember(orgId uuid.UUID, userId uuid.UUID, role string) error {
+	query := `
+		INSERT INTO organization_members (org_id, user_id, role, created_at)
+		SELECT $1, user_id, $3, $4 FROM users WHERE user_id = $2 AND kind = 'USER'
+		ON CONFLICT (org_id, user_id) DO NOTHING
+	`
+	result, err := ps.db.Exec(query, orgId, userId, role, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowAffected == 0 {
+		var exists bool
+		err := ps.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM organization_members WHERE org_id = $1 AND user_id = $2)`, orgId, userId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrAlreadyMember
+		}
+		return fmt.Errorf("User %v not found", userId)
+	}
+	return nil
+}
+
+// UpdateOrganizationMemberRole changes a member's role. The organization's
+// owners are locked so that two concurrent demotions cannot leave it without
+// one.
+func (ps *PostgresStore) UpdateOrganizationMemberRole(orgId uuid.UUID, userId uuid.UUID, role string) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := ensureOtherOwner(tx, orgId, userId, role); err != nil {
+		return err
+	}
+
+	query := `UPDATE organization_members SET role = $3 WHERE org_id = $1 AND user_id = $2`
+	if _, err := tx.Exec(query, orgId, userId, role); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ps *PostgresStore) RemoveOrganizationMember(orgId uuid.UUID, userId uuid.UUID) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := ensureOtherOwner(tx, orgId, userId, ""); err != nil {
+		return err
+	}
+
+	query := `DELETE FROM organization_members WHERE org_id = $1 AND user_id = $2`
+	if _, err := tx.Exec(query, orgId, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ensureOtherOwner locks the organization's members and fails if userId is a
+// member whose move to newRole would leave the organization without an owner.
+func ensureOtherOwner(tx *sql.Tx, orgId uuid.UUID, userId uuid.UUID, newRole string) error {
+	rows, err := tx.Query(`SELECT user_id, role FROM organization_members WHERE org_id = $1 FOR UPDATE`, orgId)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	currentRole := ""
+	otherOwners := 0
+	for rows.Next() {
+		var memberId uuid.UUID
+		var role string
+		if err := rows.Scan(&memberId, &role); err != nil {
+			return err
+		}
+		if memberId == userId {
+			currentRole = role
+		} else if role == "OWNER" {
+			otherOwners++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if currentRole == "" {
+		return ErrNotMember
+	}
+	if currentRole == "OWNER" && newRole != "OWNER" && otherOwners == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// GetMemberRole returns the role userId holds in orgId.
+func (ps *PostgresStore) GetMemberRole(orgId uuid.UUID, userId uuid.UUID) (string, error) {
+	var role string
+	err := ps.db.QueryRow(`SELECT role FROM organization_members WHERE org_id = $1 AND user_id = $2`, orgId, userId).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNotMember
+	}
+	return role, err
+}
@@ -0,0 +1,235 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+var ErrProviderNotFound = errors.New("provider not found")
+var ErrServiceNotFound = errors.New("service not found")
+
+func (ps *PostgresStore) createProviderTable() error {
+	query := `CREATE TABLE IF NOT EXISTS providers (
+        provider_id UUID PRIMARY KEY,
+        name VARCHAR(50) UNIQUE NOT NULL,
+        base_url VARCHAR(255) NOT NULL,
+        auth_style VARCHAR(20) NOT NULL CHECK (auth_style IN ('NONE', 'HEADER', 'QUERY', 'BEARER')) DEFAULT 'NONE',
+        auth_param VARCHAR(100) NOT NULL DEFAULT '',
+        usage_format VARCHAR(20) NOT NULL DEFAULT '',
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    )`
+	if _, err := ps.db.Exec(query); err != nil {
+		return err
+	}
+
+	return ps.addColumn("providers", "usage_format VARCHAR(20) NOT NULL DEFAULT ''")
+}
+
+func (ps *PostgresStore) createProviderServiceTable() error {
+	query := `CREATE TABLE IF NOT EXISTS provider_services (
+        service_id UUID PRIMARY KEY,
+        provider_id UUID NOT NULL,
+        name VARCHAR(50) NOT NULL,
+        path VARCHAR(255) NOT NULL,
+        price BIGINT NOT NULL CHECK (price > 0),
+        max_price BIGINT NOT NULL,
+        input_token_price BIGINT NOT NULL DEFAULT 0 CHECK (input_token_price >= 0),
+        output_token_price BIGINT NOT NULL DEFAULT 0 CHECK (output_token_price >= 0),
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE (provider_id, name),
+        CHECK (max_price >= price),
+        CONSTRAINT fk_service_provider
+            FOREIGN KEY (provider_id)
+                REFERENCES providers(provider_id)
+                    ON DELETE CASCADE
+    )`
+	if _, err := ps.db.Exec(query); err != nil {
+		return err
+	}
+
+	// Services priced before max_price existed may cost exactly their price.
+	err := ps.addColumn("provider_services", "max_price BIGINT",
+		`UPDATE provider_services SET max_price = price`,
+		`ALTER TABLE provider_services ALTER COLUMN max_price SET NOT NULL, ADD CONSTRAINT provider_services_check CHECK (max_price >= price)`,
+	)
+	if err != nil {
+		return err
+	}
+	return ps.addColumns("provider_services",
+		"input_token_price BIGINT NOT NULL DEFAULT 0 CHECK (input_token_price >= 0)",
+		"output_token_price BIGINT NOT NULL DEFAULT 0 CHECK (output_token_price >= 0)",
+	)
+}
+
+func (ps *PostgresStore) CreateProvider(provider *shared.Provider) error {
+	query := `
+		INSERT INTO providers (provider_id, name, base_url, auth_style, auth_param, usage_format, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := ps.db.Exec(query, provider.ProviderId, provider.Name, provider.BaseURL, provider.AuthStyle, provider.AuthParam, provider.UsageFormat, provider.CreatedAt)
+	return err
+}
+
+func (ps *PostgresStore) GetAllProviders() ([]*shared.Provider, error) {
+	rows, err := ps.db.Query("SELECT provider_id, name, base_url, auth_style, auth_param, usage_format, created_at FROM providers")
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	providers := []*shared.Provider{}
+	for rows.Next() {
+		provider, err := scanIntoProviders(rows)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+
+	return providers, nil
+}
+
+func (ps *PostgresStore) GetProviderByName(name string) (*shared.Provider, error) {
+	rows, err := ps.db.Query("SELECT provider_id, name, base_url, auth_style, auth_param, usage_format, created_at FROM providers WHERE name = $1", name)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoProviders(rows)
+	}
+
+	return nil, ErrProviderNotFound
+}
+
+func scanIntoProviders(rows *sql.Rows) (*shared.Provider, error) {
+	provider := new(shared.Provider)
+	err := rows.Scan(
+		&provider.ProviderId,
+		&provider.Name,
+		&provider.BaseURL,
+		&provider.AuthStyle,
+		&provider.AuthParam,
+		&provider.UsageFormat,
+		&provider.CreatedAt,
+	)
+	return provider, err
+}
+
+// UpsertProviderService creates a service or, if the provider already has a
+// service with the same name, replaces its path and pricing. A max price
+// below the base price is raised to it.
+func (ps *PostgresStore) UpsertProviderService(service *shared.ProviderService) (*shared.ProviderService, error) {
+	if service.Price <= 0 {
+		return nil, ErrAmountNotGreaterThanZero
+	}
+
+	if service.MaxPrice < service.Price {
+		service.MaxPrice = service.Price
+	}
+
+	query := `
+		INSERT INTO provider_services (service_id, provider_id, name, path, price, max_price, input_token_price, output_token_price, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (provider_id, name) DO UPDATE SET
+			path = EXCLUDED.path,
+			price = EXCLUDED.price,
+			max_price = EXCLUDED.max_price,
+			input_token_price = EXCLUDED.input_token_price,
+			output_token_price = EXCLUDED.output_token_price
+		RETURNING service_id, provider_id, name, path, price, max_price, input_token_price, output_token_price, created_at
+	`
+
+	saved := new(shared.ProviderService)
+	err := ps.db.QueryRow(query, service.ServiceId, service.ProviderId, service.Name, service.Path, service.Price, service.MaxPrice, service.InputTokenPrice, service.OutputTokenPrice, service.CreatedAt).Scan(
+		&saved.ServiceId,
+		&saved.ProviderId,
+		&saved.Name,
+		&saved.Path,
+		&saved.Price,
+		&saved.MaxPrice,
+		&saved.InputTokenPrice,
+		&saved.OutputTokenPrice,
+		&saved.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+func (ps *PostgresStore) GetServicesByProvider(providerName string) ([]*shared.ProviderService, error) {
+	query := `
+		SELECT s.service_id, s.provider_id, s.name, s.path, s.price, s.max_price, s.input_token_price, s.output_token_price, s.created_at
+		FROM provider_services s
+		JOIN providers p ON p.provider_id = s.provider_id
+		WHERE p.name = $1
+	`
+	rows, err := ps.db.Query(query, providerName)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	services := []*shared.ProviderService{}
+	for rows.Next() {
+		service, err := scanIntoProviderServices(rows)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, service)
+	}
+
+	return services, nil
+}
+
+func (ps *PostgresStore) GetProviderService(providerName, serviceName string) (*shared.Provider, *shared.ProviderService, error) {
+	provider, err := ps.GetProviderByName(providerName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query := `
+		SELECT service_id, provider_id, name, path, price, max_price, input_token_price, output_token_price, created_at
+		FROM provider_services
+		WHERE provider_id = $1 AND name = $2
+	`
+	rows, err := ps.db.Query(query, provider.ProviderId, serviceName)
+
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		service, err := scanIntoProviderServices(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		return provider, service, nil
+	}
+
+	return nil, nil, ErrServiceNotFound
+}
+
+func scanIntoProviderServices(rows *sql.Rows) (*shared.ProviderService, error) {
+	service := new(shared.ProviderService)
+	err := rows.Scan(
+		&service.ServiceId,
+		&service.ProviderId,
+		&service.Name,
+		&service.Path,
+		&service.Price,
+		&service.MaxPrice,
+		&service.InputTokenPrice,
+		&service.OutputTokenPrice,
+		&service.CreatedAt,
+	)
+	return service, err
+}
@@ -0,0 +1,416 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+var ErrReportNotFound = errors.New("reconciliation report not found")
+
+func (ps *PostgresStore) createReconciliationTables() error {
+	query := `CREATE TABLE IF NOT EXISTS reconciliation_reports (
+        report_id UUID PRIMARY KEY,
+        wallets_checked INT NOT NULL,
+        discrepancy_count INT NOT NULL,
+        started_at TIMESTAMP NOT NULL,
+        finished_at TIMESTAMP NOT NULL
+    );
+
+    CREATE TABLE IF NOT EXISTS reconciliation_discrepancies (
+        discrepancy_id BIGSERIAL PRIMARY KEY,
+        report_id UUID NOT NULL,
+        kind VARCHAR(30) NOT NULL,
+        user_id UUID,
+        transaction_id UUID,
+        expected BIGINT,
+        actual BIGINT,
+        detail TEXT NOT NULL,
+
+        CONSTRAINT fk_discrepancy_report
+            FOREIGN KEY (report_id)
+                REFERENCES reconciliation_reports(report_id)
+                    ON DELETE CASCADE
+    );
+
+    CREATE INDEX IF NOT EXISTS reconciliation_discrepancies_report_idx ON reconciliation_discrepancies (report_id);`
+	_, err := ps.db.Exec(query)
+	return err
+}
+
+// walletDeltas lists how each non-FAILED transaction changed each wallet. A
+// transfer debits its sender and credits its counterparty.
+const walletDeltas = `
+	SELECT user_id, transaction_id, created_at,
+		CASE WHEN type IN ('CHARGE', 'TRANSFER') THEN -amount WHEN type IN ('DEPOSIT', 'PROMO') THEN amount ELSE 0 END AS delta
+	FROM transactions
+	WHERE status IN ('SUCCEEDED', 'PENDING')
+	UNION ALL
+	SELECT counterparty_id, transaction_id, created_at, amount
+	FROM transactions
+	WHERE type = 'TRANSFER' AND status IN ('SUCCEEDED', 'PENDING')
+`
+
+// Reconcile recomputes every wallet from its transaction history and checks
+// it against the stored balance and the ledger, then stores and returns a
+// report of every invariant that does not hold. PENDING transactions created
+// before staleBefore are reported as stuck.
+//
+// A wallet's balance must equal its non-FAILED deposits, promotional credits
+// and incoming transfers minus its non-FAILED charges, which include open
+// authorizations, and outgoing transfers.
+// Refunding a charge marks it FAILED, so REFUND rows only record the reversal
+// and are not added again. The journal only moves money out of a wallet when
+// a hold is captured, so the wallet account must equal balance plus held.
+// Leased money has no transactions until its charges are flushed, so it is
+// counted in the wallet for both comparisons, and leased must equal what the
+// active and expired leases have not recorded as spent. An expired lease is
+// reported until an operator releases it.
+//
+// The checks read committed data without locking, so a wallet that is being
+// charged while the reconciler runs can be reported once and then clear up on
+// the next run.
+func (ps *PostgresStore) Reconcile(staleBefore time.Time) (*shared.ReconciliationReport, error) {
+	report := &shared.ReconciliationReport{
+		ReportId:      uuid.New(),
+		Discrepancies: []*shared.Discrepancy{},
+		StartedAt:     time.Now().UTC(),
+	}
+
+	checks := []func(*shared.ReconciliationReport) error{
+		ps.checkWallets,
+		ps.checkNegativeHistory,
+		ps.checkRefunds,
+		ps.checkJournal,
+		ps.checkExpiredLeases,
+		func(report *shared.ReconciliationReport) error {
+			return ps.checkStuckPending(report, staleBefore)
+		},
+	}
+	for _, check := range checks {
+		if err := check(report); err != nil {
+			return nil, err
+		}
+	}
+
+	report.FinishedAt = time.Now().UTC()
+
+	if err := ps.saveReconciliationReport(report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (ps *PostgresStore) checkWallets(report *shared.ReconciliationReport) error {
+	query := `
+		WITH deltas AS (` + walletDeltas + `), history AS (
+			SELECT user_id, SUM(delta) AS total
+			FROM deltas
+			GROUP BY user_id
+		), open_holds AS (
+			SELECT user_id, SUM(amount) AS total
+			FROM holds
+			WHERE status = 'AUTHORIZED'
+			GROUP BY user_id
+		), open_leases AS (
+			SELECT user_id, SUM(amount - consumed) AS total
+			FROM balance_leases
+			WHERE status IN ('ACTIVE', 'EXPIRED')
+			GROUP BY user_id
+		), wallets AS (
+			SELECT a.user_id, COALESCE(SUM(l.amount), 0) AS total
+			FROM ledger_accounts a
+			LEFT JOIN journal_legs l ON l.account_id = a.account_id
+			WHERE a.user_id IS NOT NULL
+			GROUP BY a.user_id
+		)
+		SELECT b.user_id, ` + availableBalance + `, ` + heldBalance + `, b.leased,
+			COALESCE(history.total, 0), COALESCE(open_holds.total, 0), COALESCE(open_leases.total, 0), wallets.total
+		FROM balances b
+		LEFT JOIN history ON history.user_id = b.user_id
+		LEFT JOIN open_holds ON open_holds.user_id = b.user_id
+		LEFT JOIN open_leases ON open_leases.user_id = b.user_id
+		LEFT JOIN wallets ON wallets.user_id = b.user_id
+	`
+	rows, err := ps.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userId uuid.UUID
+		var balance, held, leased, history, openHolds, openLeases int64
+		var ledger sql.NullInt64
+		if err := rows.Scan(&userId, &balance, &held, &leased, &history, &openHolds, &openLeases, &ledger); err != nil {
+			return err
+		}
+		report.WalletsChecked++
+
+		if history != balance+leased {
+			addDiscrepancy(report, "BALANCE_MISMATCH", &userId, nil, history, balance+leased,
+				"balance does not match the transaction history")
+		}
+		if openHolds != held {
+			addDiscrepancy(report, "HELD_MISMATCH", &userId, nil, openHolds, held,
+				"held amount does not match the open authorizations")
+		}
+		if openLeases != leased {
+			addDiscrepancy(report, "LEASE_MISMATCH", &userId, nil, openLeases, leased,
+				"leased amount does not match the unspent open leases")
+		}
+		if !ledger.Valid {
+			report.Discrepancies = append(report.Discrepancies, &shared.Discrepancy{
+				Kind:   "MISSING_WALLET_ACCOUNT",
+				UserId: &userId,
+				Detail: "user has no wallet account in the ledger",
+			})
+		} else if ledger.Int64 != balance+held+leased {
+			addDiscrepancy(report, "LEDGER_MISMATCH", &userId, nil, ledger.Int64, balance+held+leased,
+				"balance plus held and leased does not match the wallet's journal")
+		}
+	}
+	return rows.Err()
+}
+
+// checkNegativeHistory replays each wallet's transactions in order and
+// reports the first one after which the wallet would have been overdrawn.
+func (ps *PostgresStore) checkNegativeHistory(report *shared.ReconciliationReport) error {
+	query := `
+		SELECT DISTINCT ON (user_id) user_id, transaction_id, running
+		FROM (
+			SELECT user_id, transaction_id, created_at,
+				SUM(delta) OVER (PARTITION BY user_id ORDER BY created_at, transaction_id) AS running
+			FROM (` + walletDeltas + `) deltas
+		) history
+		WHERE running < 0
+		ORDER BY user_id, created_at, transaction_id
+	`
+	rows, err := ps.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userId, transactionId uuid.UUID
+		var running int64
+		if err := rows.Scan(&userId, &transactionId, &running); err != nil {
+			return err
+		}
+		addDiscrepancy(report, "NEGATIVE_INTERMEDIATE", &userId, &transactionId, 0, running,
+			"wallet history goes below zero after this transaction")
+	}
+	return rows.Err()
+}
+
+// checkRefunds reports refunds whose charge was not reversed and charges that
+// were refunded more than once.
+func (ps *PostgresStore) checkRefunds(report *shared.ReconciliationReport) error {
+	query := `
+		SELECT r.user_id, r.transaction_id, 'REFUND_NOT_APPLIED', 'refunded charge is still ' || c.status
+		FROM transactions r
+		JOIN transactions c ON c.transaction_id = r.parent_transaction_id
+		WHERE r.type = 'REFUND' AND c.status <> 'FAILED'
+		UNION ALL
+		SELECT c.user_id, c.transaction_id, 'DUPLICATE_REFUND', COUNT(*) || ' refunds for one charge'
+		FROM transactions r
+		JOIN transactions c ON c.transaction_id = r.parent_transaction_id
+		WHERE r.type = 'REFUND'
+		GROUP BY c.user_id, c.transaction_id
+		HAVING COUNT(*) > 1
+	`
+	rows, err := ps.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d := &shared.Discrepancy{}
+		var userId, transactionId uuid.UUID
+		if err := rows.Scan(&userId, &transactionId, &d.Kind, &d.Detail); err != nil {
+			return err
+		}
+		d.UserId = &userId
+		d.TransactionId = &transactionId
+		report.Discrepancies = append(report.Discrepancies, d)
+	}
+	return rows.Err()
+}
+
+// checkJournal reports journal entries that do not balance. The commit-time
+// trigger should make this impossible; the check proves it.
+func (ps *PostgresStore) checkJournal(report *shared.ReconciliationReport) error {
+	query := `
+		SELECT e.transaction_id, SUM(l.amount)
+		FROM journal_entries e
+		JOIN journal_legs l ON l.entry_id = e.entry_id
+		GROUP BY e.entry_id, e.transaction_id
+		HAVING SUM(l.amount) <> 0
+	`
+	rows, err := ps.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var transactionId *uuid.UUID
+		var sum int64
+		if err := rows.Scan(&transactionId, &sum); err != nil {
+			return err
+		}
+		addDiscrepancy(report, "UNBALANCED_ENTRY", nil, transactionId, 0, sum,
+			"journal entry legs do not sum to zero")
+	}
+	return rows.Err()
+}
+
+// checkExpiredLeases reports leases whose process stopped renewing them. Their
+// unspent rest stays leased until an operator has accounted for the charges
+// the process may have acknowledged and releases the lease.
+func (ps *PostgresStore) checkExpiredLeases(report *shared.ReconciliationReport) error {
+	query := `
+		SELECT lease_id, user_id, amount - consumed, expires_at
+		FROM balance_leases
+		WHERE status = 'EXPIRED'
+		ORDER BY expires_at
+	`
+	rows, err := ps.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var leaseId, userId uuid.UUID
+		var unspent int64
+		var expiresAt time.Time
+		if err := rows.Scan(&leaseId, &userId, &unspent, &expiresAt); err != nil {
+			return err
+		}
+		report.Discrepancies = append(report.Discrepancies, &shared.Discrepancy{
+			Kind:   "LEASE_EXPIRED",
+			UserId: &userId,
+			Actual: &unspent,
+			Detail: fmt.Sprintf("lease %v expired at %s with %d unaccounted for", leaseId, expiresAt.Format(time.RFC3339), unspent),
+		})
+	}
+	return rows.Err()
+}
+
+func (ps *PostgresStore) checkStuckPending(report *shared.ReconciliationReport, staleBefore time.Time) error {
+	query := `
+		SELECT user_id, transaction_id, type, created_at
+		FROM transactions
+		WHERE status = 'PENDING' AND created_at < $1
+		ORDER BY created_at
+	`
+	rows, err := ps.db.Query(query, staleBefore)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userId, transactionId uuid.UUID
+		var transactionType string
+		var createdAt time.Time
+		if err := rows.Scan(&userId, &transactionId, &transactionType, &createdAt); err != nil {
+			return err
+		}
+		report.Discrepancies = append(report.Discrepancies, &shared.Discrepancy{
+			Kind:          "STUCK_PENDING",
+			UserId:        &userId,
+			TransactionId: &transactionId,
+			Detail:        fmt.Sprintf("%s has been PENDING since %s", transactionType, createdAt.Format(time.RFC3339)),
+		})
+	}
+	return rows.Err()
+}
+
+func addDiscrepancy(report *shared.ReconciliationReport, kind string, userId *uuid.UUID, transactionId *uuid.UUID, expected int64, actual int64, detail string) {
+	report.Discrepancies = append(report.Discrepancies, &shared.Discrepancy{
+		Kind:          kind,
+		UserId:        userId,
+		TransactionId: transactionId,
+		Expected:      &expected,
+		Actual:        &actual,
+		Detail:        detail,
+	})
+}
+
+func (ps *PostgresStore) saveReconciliationReport(report *shared.ReconciliationReport) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	queryReport := `
+		INSERT INTO reconciliation_reports (report_id, wallets_checked, discrepancy_count, started_at, finished_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	_, err = tx.Exec(queryReport, report.ReportId, report.WalletsChecked, len(report.Discrepancies), report.StartedAt, report.FinishedAt)
+	if err != nil {
+		return err
+	}
+
+	queryDiscrepancy := `
+		INSERT INTO reconciliation_discrepancies (report_id, kind, user_id, transaction_id, expected, actual, detail)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	for _, d := range report.Discrepancies {
+		_, err := tx.Exec(queryDiscrepancy, report.ReportId, d.Kind, d.UserId, d.TransactionId, d.Expected, d.Actual, d.Detail)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetLatestReconciliationReport returns the most recent stored report.
+func (ps *PostgresStore) GetLatestReconciliationReport() (*shared.ReconciliationReport, error) {
+	report := &shared.ReconciliationReport{Discrepancies: []*shared.Discrepancy{}}
+	queryReport := `
+		SELECT report_id, wallets_checked, started_at, finished_at
+		FROM reconciliation_reports
+		ORDER BY started_at DESC
+		LIMIT 1
+	`
+	err := ps.db.QueryRow(queryReport).Scan(&report.ReportId, &report.WalletsChecked, &report.StartedAt, &report.FinishedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrReportNotFound
+		}
+		return nil, err
+	}
+
+	queryDiscrepancies := `
+		SELECT kind, user_id, transaction_id, expected, actual, detail
+		FROM reconciliation_discrepancies
+		WHERE report_id = $1
+		ORDER BY discrepancy_id
+	`
+	rows, err := ps.db.Query(queryDiscrepancies, report.ReportId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d := &shared.Discrepancy{}
+		if err := rows.Scan(&d.Kind, &d.UserId, &d.TransactionId, &d.Expected, &d.Actual, &d.Detail); err != nil {
+			return nil, err
+		}
+		report.Discrepancies = append(report.Discrepancies, d)
+	}
+	return report, rows.Err()
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+var ErrReplayNotFound = errors.New("stored response not found")
+
+func (ps *PostgresStore) createProxyResponseTable() error {
+	query := `CREATE TABLE IF NOT EXISTS proxy_responses (
+        api_key_id UUID NOT NULL,
+        idempotency_key VARCHAR(255) NOT NULL,
+        claim_id UUID NOT NULL,
+        request_hash VARCHAR(64) NOT NULL DEFAULT '',
+        status VARCHAR(20) NOT NULL CHECK (status IN ('IN_PROGRESS', 'COMPLETED')) DEFAULT 'IN_PROGRESS',
+        status_code INT,
+        headers JSONB,
+        body BYTEA,
+        transaction_id UUID,
+        claimed_at TIMESTAMP NOT NULL,
+        completed_at TIMESTAMP,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (api_key_id, idempotency_key),
+        CONSTRAINT fk_response_apikey
+            FOREIGN KEY (api_key_id)
+                REFERENCES api_keys(api_key_id)
+                    ON DELETE CASCADE,
+        CONSTRAINT fk_response_transaction
+            FOREIGN KEY (transaction_id)
+                REFERENCES transactions(transaction_id)
+                    ON DELETE RESTRICT
+    )`
+	if _, err := ps.db.Exec(query); err != nil {
+		return err
+	}
+
+	return ps.addColumn("proxy_responses", "request_hash VARCHAR(64) NOT NULL DEFAULT ''")
+}
+
+// ClaimIdempotencyKey marks (apiKeyId, idempotencyKey) as being processed
+// under claimId for the request hashed as requestHash. It reports true if the
+// caller now owns the key. Otherwise it returns the current record, which is
+// either a completed response to replay or a claim held by another request,
+// or ErrIdempotencyKeyReused if that record is for a different request.
+// Claims older than staleBefore are assumed abandoned by a crashed request
+// and are taken over.
+func (ps *PostgresStore) ClaimIdempotencyKey(apiKeyId uuid.UUID, idempotencyKey string, requestHash string, claimId uuid.UUID, staleBefore time.Time) (*shared.ProxyResponse, bool, error) {
+	now := time.Now().UTC()
+
+	queryClaim := `
+		INSERT INTO proxy_responses (api_key_id, idempotency_key, claim_id, request_hash, status, claimed_at, created_at)
+		VALUES ($1, $2, $3, $4, 'IN_PROGRESS', $5, $5)
+		ON CONFLICT (api_key_id, idempotency_key) DO UPDATE
+			SET claim_id = EXCLUDED.claim_id, request_hash = EXCLUDED.request_hash, claimed_at = EXCLUDED.claimed_at
+			WHERE proxy_responses.status = 'IN_PROGRESS' AND proxy_responses.claimed_at < $6
+		RETURNING claim_id
+	`
+
+	var owner uuid.UUID
+	err := ps.db.QueryRow(queryClaim, apiKeyId, idempotencyKey, claimId, requestHash, now, staleBefore).Scan(&owner)
+	if err == nil && owner == claimId {
+		return nil, true, nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, false, err
+	}
+
+	record, err := ps.GetProxyResponse(apiKeyId, idempotencyKey)
+	if err != nil {
+		return nil, false, err
+	}
+	// Records stored before requests were hashed match any request.
+	if record.RequestHash != "" && record.RequestHash != requestHash {
+		return nil, false, ErrIdempotencyKeyReused
+	}
+	return record, false, nil
+}
+
+func (ps *PostgresStore) GetProxyResponse(apiKeyId uuid.UUID, idempotencyKey string) (*shared.ProxyResponse, error) {
+	query := `
+		SELECT api_key_id, idempotency_key, claim_id, request_hash, status, status_code, headers, body, transaction_id, claimed_at, completed_at
+		FROM proxy_responses
+		WHERE api_key_id = $1 AND idempotency_key = $2
+	`
+
+	record := new(shared.ProxyResponse)
+	var statusCode sql.NullInt64
+	var headers []byte
+	err := ps.db.QueryRow(query, apiKeyId, idempotencyKey).Scan(
+		&record.ApiKeyId,
+		&record.IdempotencyKey,
+		&record.ClaimId,
+		&record.RequestHash,
+		&record.Status,
+		&statusCode,
+		&headers,
+		&record.Body,
+		&record.TransactionId,
+		&record.ClaimedAt,
+		&record.CompletedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrReplayNotFound
+		}
+		return nil, err
+	}
+
+	record.StatusCode = int(statusCode.Int64)
+	if headers != nil {
+		if err := json.Unmarshal(headers, &record.Headers); err != nil {
+			return nil, err
+		}
+	}
+
+	return record, nil
+}
+
+// CompleteIdempotencyKey stores the response produced under the caller's
+// claim. It does nothing if the claim has since been taken over.
+func (ps *PostgresStore) CompleteIdempotencyKey(record *shared.ProxyResponse) error {
+	headers, err := json.Marshal(record.Headers)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE proxy_responses
+		SET status = 'COMPLETED', status_code = $4, headers = $5, body = $6, transaction_id = $7, completed_at = $8
+		WHERE api_key_id = $1 AND idempotency_key = $2 AND claim_id = $3
+	`
+	_, err = ps.db.Exec(query, record.ApiKeyId, record.IdempotencyKey, record.ClaimId, record.StatusCode, headers, record.Body, record.TransactionId, time.Now().UTC())
+	return err
+}
+
+// ReleaseIdempotencyKey drops an unfinished claim so the key can be retried.
+func (ps *PostgresStore) ReleaseIdempotencyKey(apiKeyId uuid.UUID, idempotencyKey string, claimId uuid.UUID) error {
+	query := `DELETE FROM proxy_responses WHERE api_key_id = $1 AND idempotency_key = $2 AND claim_id = $3 AND status = 'IN_PROGRESS'`
+	_, err := ps.db.Exec(query, apiKeyId, idempotencyKey, claimId)
+	return err
+}
+
+// PruneProxyResponses deletes stored responses, and claims abandoned by a dead
+// request, that are older than the given time. Their idempotency keys can be
+// used again afterwards. It returns the number of records deleted.
+func (ps *PostgresStore) PruneProxyResponses(before time.Time) (int64, error) {
+	query := `
+		DELETE FROM proxy_responses
+		WHERE COALESCE(completed_at, claimed_at) < $1
+	`
+	result, err := ps.db.Exec(query, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
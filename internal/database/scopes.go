@@ -0,0 +1,95 @@
+package database
+
+import (
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+func (ps *PostgresStore) createApiKeyScopeTable() error {
+	query := `CREATE TABLE IF NOT EXISTS api_key_scopes (
+        api_key_id UUID NOT NULL,
+        provider VARCHAR(50) NOT NULL,
+        service VARCHAR(50) NOT NULL,
+        PRIMARY KEY (api_key_id, provider, service),
+        CONSTRAINT fk_scope_apikey
+            FOREIGN KEY (api_key_id)
+                REFERENCES api_keys(api_key_id)
+                    ON DELETE CASCADE
+    )`
+	_, err := ps.db.Exec(query)
+	return err
+}
+
+// SetApiKeyScope replaces the whole scope of a key owned by userId.
+func (ps *PostgresStore) SetApiKeyScope(userId uuid.UUID, apiKeyId uuid.UUID, scope *shared.ApiKeyScope) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	queryKey := `UPDATE api_keys SET max_call_cost = $3, allowed_methods = $4 WHERE user_id = $1 AND api_key_id = $2`
+	result, err := tx.Exec(queryKey, userId, apiKeyId, scope.MaxCallCost, pq.Array(scope.AllowedMethods))
+	if err != nil {
+		return err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowAffected == 0 {
+		return ErrApiKeyNotFound
+	}
+
+	if _, err := tx.Exec(`DELETE FROM api_key_scopes WHERE api_key_id = $1`, apiKeyId); err != nil {
+		return err
+	}
+
+	queryScope := `
+		INSERT INTO api_key_scopes (api_key_id, provider, service)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+	`
+	for _, service := range scope.Services {
+		if _, err := tx.Exec(queryScope, apiKeyId, service.Provider, service.Service); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (ps *PostgresStore) loadApiKeyServiceScopes(apiKeys []*shared.ApiKey) error {
+	if len(apiKeys) == 0 {
+		return nil
+	}
+
+	byId := map[uuid.UUID]*shared.ApiKey{}
+	ids := make([]string, 0, len(apiKeys))
+	for _, apiKey := range apiKeys {
+		byId[apiKey.ApiKeyId] = apiKey
+		ids = append(ids, apiKey.ApiKeyId.String())
+	}
+
+	query := `SELECT api_key_id, provider, service FROM api_key_scopes WHERE api_key_id = ANY($1::uuid[]) ORDER BY provider, service`
+	rows, err := ps.db.Query(query, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var apiKeyId uuid.UUID
+		service := shared.ServiceScope{}
+		if err := rows.Scan(&apiKeyId, &service.Provider, &service.Service); err != nil {
+			return err
+		}
+		apiKey := byId[apiKeyId]
+		apiKey.Scope.Services = append(apiKey.Scope.Services, service)
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+var ErrSecretNotFound = errors.New("secret not found")
+
+func (ps *PostgresStore) createProviderSecretTable() error {
+	query := `CREATE TABLE IF NOT EXISTS provider_secrets (
+        secret_id UUID PRIMARY KEY,
+        provider_id UUID NOT NULL,
+        ciphertext BYTEA NOT NULL,
+        hint VARCHAR(8) NOT NULL,
+        status VARCHAR(20) NOT NULL CHECK (status IN ('ACTIVE', 'RETIRED')) DEFAULT 'ACTIVE',
+        last_used_at TIMESTAMP,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        CONSTRAINT fk_secret_provider
+            FOREIGN KEY (provider_id)
+                REFERENCES providers(provider_id)
+                    ON DELETE CASCADE
+    )`
+	_, err := ps.db.Exec(query)
+	return err
+}
+
+func (ps *PostgresStore) createSecretUsageTable() error {
+	query := `CREATE TABLE IF NOT EXISTS provider_secret_usages (
+        transaction_id UUID PRIMARY KEY,
+        secret_id UUID NOT NULL,
+        used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        CONSTRAINT fk_usage_secret
+            FOREIGN KEY (secret_id)
+                REFERENCES provider_secrets(secret_id)
+                    ON DELETE RESTRICT,
+        CONSTRAINT fk_usage_transaction
+            FOREIGN KEY (transaction_id)
+                REFERENCES transactions(transaction_id)
+                    ON DELETE RESTRICT
+    )`
+	_, err := ps.db.Exec(query)
+	return err
+}
+
+func (ps *PostgresStore) CreateProviderSecret(secret *shared.ProviderSecret) error {
+	query := `
+		INSERT INTO provider_secrets (secret_id, provider_id, ciphertext, hint, status, created_at)
+		VALUES ($1, $2, $3, $4, 'ACTIVE', $5)
+	`
+	_, err := ps.db.Exec(query, secret.SecretId, secret.ProviderId, secret.Ciphertext, secret.Hint, secret.CreatedAt)
+	return err
+}
+
+func (ps *PostgresStore) GetProviderSecrets(providerId uuid.UUID) ([]*shared.ProviderSecret, error) {
+	query := `
+		SELECT secret_id, provider_id, ciphertext, hint, status, last_used_at, created_at
+		FROM provider_secrets
+		WHERE provider_id = $1
+		ORDER BY created_at
+	`
+	return ps.querySecrets(query, providerId)
+}
+
+// GetActiveProviderSecrets returns every secret that may currently be used to
+// call the provider. Several can be active at once while a key is rotated.
+func (ps *PostgresStore) GetActiveProviderSecrets(providerId uuid.UUID) ([]*shared.ProviderSecret, error) {
+	query := `
+		SELECT secret_id, provider_id, ciphertext, hint, status, last_used_at, created_at
+		FROM provider_secrets
+		WHERE provider_id = $1 AND status = 'ACTIVE'
+		ORDER BY created_at
+	`
+	return ps.querySecrets(query, providerId)
+}
+
+func (ps *PostgresStore) querySecrets(query string, args ...any) ([]*shared.ProviderSecret, error) {
+	rows, err := ps.db.Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	secrets := []*shared.ProviderSecret{}
+	for rows.Next() {
+		secret, err := scanIntoProviderSecrets(rows)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+
+	return secrets, nil
+}
+
+func scanIntoProviderSecrets(rows *sql.Rows) (*shared.ProviderSecret, error) {
+	secret := new(shared.ProviderSecret)
+	err := rows.Scan(
+		&secret.SecretId,
+		&secret.ProviderId,
+		&secret.Ciphertext,
+		&secret.Hint,
+		&secret.Status,
+		&secret.LastUsedAt,
+		&secret.CreatedAt,
+	)
+	return secret, err
+}
+
+func (ps *PostgresStore) RetireProviderSecret(providerId uuid.UUID, secretId uuid.UUID) error {
+	query := `UPDATE provider_secrets SET status = 'RETIRED' WHERE provider_id = $1 AND secret_id = $2`
+	result, err := ps.db.Exec(query, providerId, secretId)
+	if err != nil {
+		return err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowAffected == 0 {
+		return ErrSecretNotFound
+	}
+	return nil
+}
+
+// RecordSecretUsage links a transaction to the secret that was injected into
+// its upstream request. The secret's last_used_at is refreshed at most once a
+// minute, since every tenant's calls to the provider share its row.
+func (ps *PostgresStore) RecordSecretUsage(secretId uuid.UUID, transactionId uuid.UUID) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	queryUsage := `
+		INSERT INTO provider_secret_usages (transaction_id, secret_id)
+		VALUES ($1, $2)
+		ON CONFLICT (transaction_id) DO NOTHING
+	`
+	if _, err := tx.Exec(queryUsage, transactionId, secretId); err != nil {
+		return err
+	}
+
+	querySecret := `
+		UPDATE provider_secrets SET last_used_at = $2
+		WHERE secret_id = $1 AND (last_used_at IS NULL OR last_used_at < $3)
+	`
+	now := time.Now().UTC()
+	if _, err := tx.Exec(querySecret, secretId, now, now.Add(-time.Minute)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+var ErrNoUpstreamResult = errors.New("no upstream result recorded")
+
+// GetStalePendingTransactions returns up to limit transactions that have been
+// PENDING since before the given time, oldest first. Holds placed through
+// POST /holds are left out: they stay open until their owner captures or
+// voids them, however long that takes. So are transactions whose settlement
+// was deferred past now.
+func (ps *PostgresStore) GetStalePendingTransactions(before time.Time, now time.Time, limit int) ([]*shared.Transaction, error) {
+	query := `
+		SELECT transaction_id, user_id, idempotency_key, amount, type, status, status_reason, parent_transaction_id, api_key_id, provider_id, counterparty_id, member_id, created_at
+		FROM transactions
+		WHERE status = 'PENDING' AND created_at < $1
+			AND (next_attempt_at IS NULL OR next_attempt_at <= $2)
+			AND (provider_id IS NOT NULL
+				OR NOT EXISTS (SELECT 1 FROM holds WHERE holds.transaction_id = transactions.transaction_id))
+		ORDER BY created_at
+		LIMIT $3
+	`
+	rows, err := ps.db.Query(query, before, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []*shared.Transaction{}
+	for rows.Next() {
+		transaction, err := scanIntoTransactions(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	return transactions, rows.Err()
+}
+
+// GetUpstreamResult returns the status code the provider answered a proxied
+// call with, from the audit log or, failing that, the stored response, and
+// the metered cost of the call if the audit log recorded one.
+func (ps *PostgresStore) GetUpstreamResult(transactionId uuid.UUID) (int, *int64, error) {
+	query := `
+		SELECT status_code, metered_cost FROM (
+			SELECT status_code, metered_cost, 0 AS source, created_at
+			FROM audit_log
+			WHERE transaction_id = $1 AND NOT replayed
+			UNION ALL
+			SELECT status_code, NULL, 1 AS source, completed_at
+			FROM proxy_responses
+			WHERE transaction_id = $1 AND status = 'COMPLETED'
+		) results
+		ORDER BY source, created_at
+		LIMIT 1
+	`
+	var statusCode int
+	var meteredCost *int64
+	err := ps.db.QueryRow(query, transactionId).Scan(&statusCode, &meteredCost)
+	if err == sql.ErrNoRows {
+		return 0, nil, ErrNoUpstreamResult
+	}
+	return statusCode, meteredCost, err
+}
+
+// DeferSettlement records a failed attempt to settle a transaction and keeps
+// it out of GetStalePendingTransactions for backoff, doubled for every
+// earlier failure up to maxBackoff, so that it does not hold up the rows
+// behind it. It returns how many attempts have failed so far.
+func (ps *PostgresStore) DeferSettlement(transactionId uuid.UUID, now time.Time, backoff time.Duration, maxBackoff time.Duration) (int, error) {
+	query := `
+		UPDATE transactions
+		SET settlement_attempts = settlement_attempts + 1,
+			next_attempt_at = $2::timestamp + LEAST($3::float8 * power(2, settlement_attempts), $4::float8) * INTERVAL '1 second'
+		WHERE transaction_id = $1
+		RETURNING settlement_attempts
+	`
+	var attempts int
+	err := ps.db.QueryRow(query, transactionId, now, backoff.Seconds(), maxBackoff.Seconds()).Scan(&attempts)
+	return attempts, err
+}
+
+// ConfirmTransaction marks a PENDING transaction that has no hold as
+// SUCCEEDED. It reports false if the transaction was no longer PENDING.
+func (ps *PostgresStore) ConfirmTransaction(transactionId uuid.UUID, reason string) (bool, error) {
+	query := `
+		UPDATE transactions
+		SET status = 'SUCCEEDED', status_reason = $1
+		WHERE transaction_id = $2 AND status = 'PENDING'
+			AND NOT EXISTS (SELECT 1 FROM holds WHERE holds.transaction_id = transactions.transaction_id)
+	`
+	result, err := ps.db.Exec(query, reason, transactionId)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (ps *PostgresStore) SetTransactionReason(transactionId uuid.UUID, reason string) error {
+	query := `UPDATE transactions SET status_reason = $1 WHERE transaction_id = $2`
+	_, err := ps.db.Exec(query, reason, transactionId)
+	return err
+}
@@ -0,0 +1,427 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// A wallet can be switched into sharded mode to take many concurrent charges.
+// Its available money is then split between the main balances row and N rows
+// in balance_shards, and a charge debits any shard that covers it and is not
+// locked by another charge instead of queueing on the main row. Every row is
+// kept non-negative by its CHECK constraint and a charge must fit in the one
+// row it debits, so the wallet as a whole can never go below zero.
+//
+// Charges, holds and transfers take money from the shards the same way. A
+// hold is reserved on the row it was taken from, which carries it in its own
+// held balance until the hold is captured or voided, so that settling it does
+// not queue on the main row either. Deposits and refunds credit the main row,
+// and sweeps debit it, gathering the shards into it first. The rebalancer
+// spreads the money evenly over the shards again, leaving the remainder of
+// the division on the main row.
+//
+// A shard that still carries a reservation outlives a change of the shard
+// count; it takes no new money from the rebalancer and is dropped once its
+// holds are closed.
+
+const maxBalanceShards = 64
+
+var ErrInvalidShardCount = errors.New("shard count must be between 0 and 64")
+
+// availableBalance is the available balance of the balances row aliased b,
+// including its shards.
+const availableBalance = `(b.balance + COALESCE((SELECT SUM(s.balance) FROM balance_shards s WHERE s.user_id = b.user_id), 0))`
+
+// heldBalance is the held balance of the balances row aliased b, including
+// its shards.
+const heldBalance = `(b.held + COALESCE((SELECT SUM(s.held) FROM balance_shards s WHERE s.user_id = b.user_id), 0))`
+
+func (ps *PostgresStore) createBalanceShardTable() error {
+	query := `CREATE TABLE IF NOT EXISTS balance_shards (
+        user_id UUID NOT NULL,
+        shard INT NOT NULL,
+        balance BIGINT NOT NULL DEFAULT 0 CHECK (balance >= 0),
+        held BIGINT NOT NULL DEFAULT 0 CHECK (held >= 0),
+        PRIMARY KEY (user_id, shard),
+        CONSTRAINT fk_shard_balance
+            FOREIGN KEY (user_id)
+                REFERENCES balances(user_id)
+                    ON DELETE RESTRICT
+    )`
+	if _, err := ps.db.Exec(query); err != nil {
+		return err
+	}
+
+	return ps.addColumn("balance_shards", "held BIGINT NOT NULL DEFAULT 0 CHECK (held >= 0)")
+}
+
+// debitWallet takes amount from the wallet's available balance or fails with
+// ErrInsufficientFunds. A sharded wallet is first tried on a free shard, so
+// concurrent charges rarely wait on one another; otherwise the main row is
+// debited with the store's balance strategy.
+func (ps *PostgresStore) debitWallet(tx *sql.Tx, userId uuid.UUID, amount int64) error {
+	_, err := ps.takeFromWallet(tx, userId, amount, 0)
+	return err
+}
+
+// reserveWallet moves amount from the wallet's available balance to its held
+// balance, the same way debitWallet takes it, and returns the shard it was
+// reserved on, or nil for the main row. The reservation stays on that row
+// until settleReservation or releaseReservation closes it.
+func (ps *PostgresStore) reserveWallet(tx *sql.Tx, userId uuid.UUID, amount int64) (*int, error) {
+	return ps.takeFromWallet(tx, userId, amount, amount)
+}
+
+// takeFromWallet debits amount from one of the wallet's rows, adds held to
+// that row's held balance and returns the shard it debited, or nil for the
+// main row.
+func (ps *PostgresStore) takeFromWallet(tx *sql.Tx, userId uuid.UUID, amount int64, held int64) (*int, error) {
+	shard, err := debitShard(tx, userId, amount, held, true)
+	if err != nil || shard != nil {
+		return shard, err
+	}
+
+	err = ps.strategy.debit(tx, userId, amount)
+	if err == nil {
+		return nil, holdOnMainRow(tx, userId, held)
+	}
+	if !errors.Is(err, ErrInsufficientFunds) {
+		return nil, err
+	}
+
+	var shardCount int
+	queryRead := `SELECT shard_count FROM balances WHERE user_id = $1 FOR UPDATE`
+
+	err = tx.QueryRow(queryRead, userId).Scan(&shardCount)
+	if err != nil {
+		return nil, err
+	}
+	if shardCount == 0 {
+		return nil, ErrInsufficientFunds
+	}
+
+	// The shards may have been busy rather than empty.
+	shard, err = debitShard(tx, userId, amount, held, false)
+	if err != nil || shard != nil {
+		return shard, err
+	}
+	// No single row covers the amount, but together they might.
+	balance, err := gatherShards(tx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if balance < amount {
+		return nil, ErrInsufficientFunds
+	}
+
+	queryUpdate := `
+        UPDATE balances 
+        SET balance = $1, held = held + $3
+        WHERE user_id = $2
+    `
+	_, err = tx.Exec(queryUpdate, balance-amount, userId, held)
+	return nil, err
+}
+
+func holdOnMainRow(tx *sql.Tx, userId uuid.UUID, held int64) error {
+	if held == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`UPDATE balances SET held = held + $1 WHERE user_id = $2`, held, userId)
+	return err
+}
+
+// debitShard debits amount from one of the wallet's shards that covers it,
+// adds held to that shard's held balance and returns the shard. With
+// skipLocked it only considers shards no other transaction holds and picks
+// one at random to spread charges out; otherwise it waits for the fullest
+// one. It returns nil if no shard was debited, which is always the case for a
+// wallet that is not sharded.
+func debitShard(tx *sql.Tx, userId uuid.UUID, amount int64, held int64, skipLocked bool) (*int, error) {
+	pick := `ORDER BY balance DESC LIMIT 1 FOR UPDATE`
+	if skipLocked {
+		pick = `ORDER BY random() LIMIT 1 FOR UPDATE SKIP LOCKED`
+	}
+
+	query := `
+		UPDATE balance_shards SET balance = balance - $2, held = held + $3
+		WHERE user_id = $1 AND shard = (
+			SELECT shard FROM balance_shards
+			WHERE user_id = $1 AND balance >= $2
+			` + pick + `
+		)
+		RETURNING shard
+	`
+	var shard int
+	err := tx.QueryRow(query, userId, amount, held).Scan(&shard)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &shard, nil
+}
+
+// settleReservation closes a reservation of held made by reserveWallet on
+// shard, or on the main row if shard is nil, and takes extra more from the
+// wallet or, if extra is negative, gives that much back. The row the money
+// was reserved on settles it alone when it covers extra; otherwise the
+// reservation is given back and the whole amount taken as debitWallet would,
+// failing with ErrInsufficientFunds if the wallet cannot cover it.
+func (ps *PostgresStore) settleReservation(tx *sql.Tx, userId uuid.UUID, shard *int, held int64, extra int64) error {
+	var result sql.Result
+	var err error
+	if shard != nil {
+		query := `
+			UPDATE balance_shards SET balance = balance - $4, held = held - $3
+			WHERE user_id = $1 AND shard = $2 AND balance >= $4
+		`
+		result, err = tx.Exec(query, userId, *shard, held, extra)
+	} else {
+		query := `
+			UPDATE balances SET balance = balance - $3, held = held - $2
+			WHERE user_id = $1 AND balance >= $3
+		`
+		result, err = tx.Exec(query, userId, held, extra)
+	}
+	if err != nil {
+		return err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowAffected > 0 {
+		return nil
+	}
+
+	// The main row is locked before any shard, as everywhere else.
+	if _, err := tx.Exec(`SELECT 1 FROM balances WHERE user_id = $1 FOR UPDATE`, userId); err != nil {
+		return err
+	}
+	if err := releaseReservation(tx, userId, shard, held); err != nil {
+		return err
+	}
+	return ps.debitWallet(tx, userId, held+extra)
+}
+
+// releaseReservation gives a reservation of held made by reserveWallet back
+// to the available balance of the row it was reserved on.
+func releaseReservation(tx *sql.Tx, userId uuid.UUID, shard *int, held int64) error {
+	if shard == nil {
+		query := `UPDATE balances SET balance = balance + $1, held = held - $1 WHERE user_id = $2`
+		_, err := tx.Exec(query, held, userId)
+		return err
+	}
+
+	query := `UPDATE balance_shards SET balance = balance + $3, held = held - $3 WHERE user_id = $1 AND shard = $2`
+	_, err := tx.Exec(query, userId, *shard, held)
+	return err
+}
+
+// gatherShards moves everything held in the wallet's shards to its main row
+// and returns the main row's new balance. The caller must hold the main row's
+// lock, which is always taken before any shard lock.
+func gatherShards(tx *sql.Tx, userId uuid.UUID) (int64, error) {
+	query := `
+		WITH gathered AS (
+			SELECT shard, balance FROM balance_shards
+			WHERE user_id = $1 AND balance > 0
+			ORDER BY shard
+			FOR UPDATE
+		), cleared AS (
+			UPDATE balance_shards s SET balance = 0
+			FROM gathered g
+			WHERE s.user_id = $1 AND s.shard = g.shard
+			RETURNING g.balance
+		)
+		UPDATE balances SET balance = balance + COALESCE((SELECT SUM(balance) FROM cleared), 0)
+		WHERE user_id = $1
+		RETURNING balance
+	`
+	var balance int64
+	err := tx.QueryRow(query, userId).Scan(&balance)
+	return balance, err
+}
+
+// SetBalanceShards switches the wallet to count shards, or back to a single
+// balance row with a count of 0, and spreads its available money over them.
+func (ps *PostgresStore) SetBalanceShards(userId uuid.UUID, count int) error {
+	if count < 0 || count > maxBalanceShards {
+		return ErrInvalidShardCount
+	}
+
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var shardCount int
+	queryRead := `SELECT shard_count FROM balances WHERE user_id = $1 FOR UPDATE`
+	if err := tx.QueryRow(queryRead, userId).Scan(&shardCount); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("User %v not found", userId)
+		}
+		return err
+	}
+
+	if err := lockShards(tx, userId); err != nil {
+		return err
+	}
+
+	balance, err := gatherShards(tx, userId)
+	if err != nil {
+		return err
+	}
+
+	queryShards := `
+		INSERT INTO balance_shards (user_id, shard)
+		SELECT $1, generate_series(0, $2 - 1)
+		ON CONFLICT DO NOTHING
+	`
+	if _, err := tx.Exec(queryShards, userId, count); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE balances SET shard_count = $2 WHERE user_id = $1`, userId, count); err != nil {
+		return err
+	}
+
+	if err := spreadShards(tx, userId, count, balance); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RebalanceShards evens out a sharded wallet whose money has drifted: when
+// the main row holds more than the remainder of an even split, a shard has
+// fallen below half its share, or a shard left over from an earlier shard
+// count has money back or can be dropped. It reports whether it moved
+// anything.
+func (ps *PostgresStore) RebalanceShards(userId uuid.UUID) (bool, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	var balance int64
+	var shardCount int
+	queryRead := `SELECT balance, shard_count FROM balances WHERE user_id = $1 FOR UPDATE`
+	if err := tx.QueryRow(queryRead, userId).Scan(&balance, &shardCount); err != nil {
+		return false, err
+	}
+
+	rows, err := tx.Query(`SELECT shard, balance, held FROM balance_shards WHERE user_id = $1 ORDER BY shard FOR UPDATE`, userId)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	total := balance
+	shards := []int64{}
+	skewed := false
+	for rows.Next() {
+		var shard int
+		var shardBalance, held int64
+		if err := rows.Scan(&shard, &shardBalance, &held); err != nil {
+			return false, err
+		}
+		total += shardBalance
+		if shard >= shardCount {
+			// Left over from an earlier shard count.
+			skewed = skewed || shardBalance > 0 || held == 0
+			continue
+		}
+		shards = append(shards, shardBalance)
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if shardCount == 0 && !skewed {
+		return false, nil
+	}
+
+	if shardCount > 0 {
+		share := total / int64(shardCount)
+		skewed = skewed || balance > total%int64(shardCount)
+		for _, shard := range shards {
+			if shard < share/2 {
+				skewed = true
+			}
+		}
+	}
+	if !skewed {
+		return false, nil
+	}
+
+	if err := spreadShards(tx, userId, shardCount, total); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// lockShards locks every shard of the wallet, in order. The caller must hold
+// the main row.
+func lockShards(tx *sql.Tx, userId uuid.UUID) error {
+	_, err := tx.Exec(`SELECT 1 FROM balance_shards WHERE user_id = $1 ORDER BY shard FOR UPDATE`, userId)
+	return err
+}
+
+// spreadShards splits total evenly over the wallet's first shardCount shards
+// and leaves the remainder on the main row. Shards past the count are emptied,
+// and dropped once no hold is reserved on them. The caller must hold the main
+// row and every shard.
+func spreadShards(tx *sql.Tx, userId uuid.UUID, shardCount int, total int64) error {
+	share, remainder := int64(0), total
+	if shardCount > 0 {
+		share = total / int64(shardCount)
+		remainder = total % int64(shardCount)
+	}
+
+	queryShards := `UPDATE balance_shards SET balance = CASE WHEN shard < $3 THEN $2 ELSE 0 END WHERE user_id = $1`
+	if _, err := tx.Exec(queryShards, userId, share, shardCount); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM balance_shards WHERE user_id = $1 AND shard >= $2 AND held = 0`, userId, shardCount); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`UPDATE balances SET balance = $2 WHERE user_id = $1`, userId, remainder)
+	return err
+}
+
+// GetShardedWallets returns the users whose wallets are sharded or still
+// have shards left over from an earlier shard count.
+func (ps *PostgresStore) GetShardedWallets() ([]uuid.UUID, error) {
+	query := `
+		SELECT user_id FROM balances b
+		WHERE shard_count > 0 OR EXISTS (SELECT 1 FROM balance_shards s WHERE s.user_id = b.user_id)
+	`
+	rows, err := ps.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIds := []uuid.UUID{}
+	for rows.Next() {
+		var userId uuid.UUID
+		if err := rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, userId)
+	}
+
+	return userIds, rows.Err()
+}
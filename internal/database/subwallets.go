@@ -0,0 +1,242 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+// A sub-wallet is an allocated slice of a user's or organization's money for
+// a single agent. Like an organization it is stored as a users row, of kind
+// WALLET, so it has its own balance, ledger account, transactions and API
+// keys; spending with its keys debits the sub-wallet only. Its limits cap
+// what it may spend no matter how much it is topped up with.
+
+var ErrSubWalletNotFound = errors.New("sub-wallet not found")
+var ErrSubWalletNameTaken = errors.New("a sub-wallet with this name already exists")
+var ErrWalletLimitExceeded = errors.New("wallet spending limit exceeded")
+
+func (ps *PostgresStore) createSubWalletTable() error {
+	query := `CREATE TABLE IF NOT EXISTS sub_wallets (
+        wallet_id UUID PRIMARY KEY,
+        parent_id UUID NOT NULL,
+        name VARCHAR(50) NOT NULL,
+        hard_cap BIGINT CHECK (hard_cap >= 0),
+        daily_limit BIGINT CHECK (daily_limit >= 0),
+        weekly_limit BIGINT CHECK (weekly_limit >= 0),
+        monthly_limit BIGINT CHECK (monthly_limit >= 0),
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE (parent_id, name),
+        CONSTRAINT fk_sub_wallet_wallet
+            FOREIGN KEY (wallet_id)
+                REFERENCES users(user_id)
+                    ON DELETE RESTRICT,
+        CONSTRAINT fk_sub_wallet_parent
+            FOREIGN KEY (parent_id)
+                REFERENCES users(user_id)
+                    ON DELETE RESTRICT
+    )`
+	_, err := ps.db.Exec(query)
+	return err
+}
+
+// CreateSubWallet creates an empty sub-wallet under wallet.ParentId. Money is
+// allocated to it afterwards with a transfer from the parent.
+func (ps *PostgresStore) CreateSubWallet(wallet *shared.SubWallet) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	// Sub-wallets never log in, so their users row only needs unique
+	// placeholders; the name lives in sub_wallets and is unique per parent.
+	queryUser := `
+		INSERT INTO users (user_id, username, email, password, kind, created_at)
+		VALUES ($1, $2, $3, '', 'WALLET', $4)
+	`
+	placeholder := fmt.Sprintf("wallet-%v", wallet.WalletId)
+	if _, err := tx.Exec(queryUser, wallet.WalletId, placeholder, placeholder, wallet.CreatedAt); err != nil {
+		return err
+	}
+
+	queryBalance := `
+		INSERT INTO balances (user_id, balance, created_at)
+		VALUES ($1, $2, $3)
+	`
+	if _, err := tx.Exec(queryBalance, wallet.WalletId, 0, wallet.CreatedAt); err != nil {
+		return err
+	}
+
+	if err := createWalletAccount(tx, wallet.WalletId, wallet.CreatedAt); err != nil {
+		return err
+	}
+
+	queryWallet := `
+		INSERT INTO sub_wallets (wallet_id, parent_id, name, hard_cap, daily_limit, weekly_limit, monthly_limit, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err = tx.Exec(queryWallet, wallet.WalletId, wallet.ParentId, wallet.Name, wallet.Limits.HardCap, wallet.Limits.DailyLimit, wallet.Limits.WeeklyLimit, wallet.Limits.MonthlyLimit, wallet.CreatedAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrSubWalletNameTaken
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const subWalletColumns = `w.wallet_id, w.parent_id, w.name, w.hard_cap, w.daily_limit, w.weekly_limit, w.monthly_limit,
+	` + availableBalance + `, ` + heldBalance + `, w.created_at`
+
+func (ps *PostgresStore) GetSubWallet(walletId uuid.UUID) (*shared.SubWallet, error) {
+	query := `
+		SELECT ` + subWalletColumns + `
+		FROM sub_wallets w
+		JOIN balances b ON b.user_id = w.wallet_id
+		WHERE w.wallet_id = $1
+	`
+	wallet, err := scanSubWallet(ps.db.QueryRow(query, walletId))
+	if err == sql.ErrNoRows {
+		return nil, ErrSubWalletNotFound
+	}
+	return wallet, err
+}
+
+func (ps *PostgresStore) GetSubWalletsByParent(parentId uuid.UUID) ([]*shared.SubWallet, error) {
+	query := `
+		SELECT ` + subWalletColumns + `
+		FROM sub_wallets w
+		JOIN balances b ON b.user_id = w.wallet_id
+		WHERE w.parent_id = $1
+		ORDER BY w.created_at
+	`
+	rows, err := ps.db.Query(query, parentId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	wallets := []*shared.SubWallet{}
+	for rows.Next() {
+		wallet, err := scanSubWallet(rows)
+		if err != nil {
+			return nil, err
+		}
+		wallets = append(wallets, wallet)
+	}
+
+	return wallets, rows.Err()
+}
+
+func scanSubWallet(row rowScanner) (*shared.SubWallet, error) {
+	wallet := new(shared.SubWallet)
+	err := row.Scan(
+		&wallet.WalletId,
+		&wallet.ParentId,
+		&wallet.Name,
+		&wallet.Limits.HardCap,
+		&wallet.Limits.DailyLimit,
+		&wallet.Limits.WeeklyLimit,
+		&wallet.Limits.MonthlyLimit,
+		&wallet.Balance,
+		&wallet.Held,
+		&wallet.CreatedAt,
+	)
+	return wallet, err
+}
+
+func (ps *PostgresStore) SetSubWalletLimits(walletId uuid.UUID, limits *shared.ApiKeyBudget) error {
+	query := `
+		UPDATE sub_wallets SET hard_cap = $2, daily_limit = $3, weekly_limit = $4, monthly_limit = $5
+		WHERE wallet_id = $1
+	`
+	result, err := ps.db.Exec(query, walletId, limits.HardCap, limits.DailyLimit, limits.WeeklyLimit, limits.MonthlyLimit)
+	if err != nil {
+		return err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowAffected == 0 {
+		return ErrSubWalletNotFound
+	}
+	return nil
+}
+
+// SweepSubWallet moves unused money from the sub-wallet transaction.UserId
+// back to its parent, transaction.CounterpartyId. An amount of 0 sweeps the
+// whole available balance; money held for calls in flight stays behind. The
+// idempotency key belongs to the sub-wallet.
+func (ps *PostgresStore) SweepSubWallet(transaction *shared.Transaction) (*shared.Transaction, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	if transaction.Amount < 0 {
+		return nil, ErrAmountNotGreaterThanZero
+	}
+	if transaction.CounterpartyId == nil {
+		return nil, ErrRecipientNotFound
+	}
+
+	// Hash the requested amount, not the swept one, so a retried sweep of
+	// everything still matches after the balance has changed.
+	requestHash := requestFingerprint("SWEEP", transaction.Amount, transaction.CounterpartyId)
+
+	if transaction.Amount == 0 {
+		if err := lockBalances(tx, transaction.UserId, *transaction.CounterpartyId); err != nil {
+			return nil, err
+		}
+		transaction.Amount, err = gatherShards(tx, transaction.UserId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sweep, err := ps.transferFunds(tx, transaction, requestHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return sweep, tx.Commit()
+}
+
+// checkWalletLimits fails with ErrWalletLimitExceeded if the live charges of
+// a sub-wallet, including any written earlier in tx, pass its limits. It
+// locks the sub-wallet row, after any balance or shard lock, so charges on
+// different shards of the same wallet cannot both slip under a limit. Other
+// wallets have no limits.
+func checkWalletLimits(tx *sql.Tx, userId uuid.UUID) error {
+	limits := new(shared.ApiKeyBudget)
+	query := `SELECT hard_cap, daily_limit, weekly_limit, monthly_limit FROM sub_wallets WHERE wallet_id = $1 FOR UPDATE`
+	err := tx.QueryRow(query, userId).Scan(&limits.HardCap, &limits.DailyLimit, &limits.WeeklyLimit, &limits.MonthlyLimit)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if limits.IsUnlimited() {
+		return nil
+	}
+
+	exceeded, err := spendExceeds(tx, "user_id = $1", userId, limits)
+	if err != nil {
+		return err
+	}
+	if exceeded {
+		return ErrWalletLimitExceeded
+	}
+	return nil
+}
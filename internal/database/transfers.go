@@ -0,0 +1,141 @@
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+var ErrRecipientNotFound = errors.New("recipient not found")
+var ErrTransferToSelf = errors.New("cannot transfer to the same wallet")
+
+// Transfer moves transaction.Amount from transaction.UserId's wallet to
+// transaction.CounterpartyId's wallet. It follows Charge: the idempotency key
+// belongs to the sender, and the sender's balance must cover the amount.
+func (ps *PostgresStore) Transfer(transaction *shared.Transaction) (*shared.Transaction, error) {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	requestHash := requestFingerprint(transaction.Type, transaction.Amount, transaction.CounterpartyId)
+
+	transfer, err := ps.transferFunds(tx, transaction, requestHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return transfer, tx.Commit()
+}
+
+// transferFunds records the TRANSFER transaction and moves its amount between
+// the two wallets, or returns the transfer an earlier request stored under
+// the same idempotency key.
+func (ps *PostgresStore) transferFunds(tx *sql.Tx, transaction *shared.Transaction, requestHash string) (*shared.Transaction, error) {
+	if transaction.CounterpartyId == nil {
+		return nil, ErrRecipientNotFound
+	}
+	if *transaction.CounterpartyId == transaction.UserId {
+		return nil, ErrTransferToSelf
+	}
+
+	queryTransaction := `
+		INSERT INTO transactions (transaction_id, user_id, idempotency_key, request_hash, amount, type, status, counterparty_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, 'SUCCEEDED', $7, $8)
+		ON CONFLICT (user_id, idempotency_key) WHERE idempotency_expired_at IS NULL DO NOTHING
+	`
+
+	result, err := tx.Exec(queryTransaction, transaction.TransactionId, transaction.UserId, transaction.IdempotencyKey, requestHash, transaction.Amount, transaction.Type, transaction.CounterpartyId, transaction.CreatedAt)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return nil, ErrRecipientNotFound
+		}
+		return nil, err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowAffected == 0 {
+		return readIdempotentTransaction(tx, transaction.UserId, transaction.IdempotencyKey, requestHash)
+	}
+
+	if transaction.Amount <= 0 {
+		return nil, ErrAmountNotGreaterThanZero
+	}
+
+	// Both wallets are locked up front, in order, because the recipient's
+	// main row is credited; the sender is then debited like a charge, from a
+	// shard when one covers the amount.
+	if err := lockBalances(tx, transaction.UserId, *transaction.CounterpartyId); err != nil {
+		return nil, err
+	}
+	if err := ps.debitWallet(tx, transaction.UserId, transaction.Amount); err != nil {
+		return nil, err
+	}
+
+	queryUpdate := `
+        UPDATE balances 
+        SET balance = balance + $1
+        WHERE user_id = $2
+    `
+	if _, err := tx.Exec(queryUpdate, transaction.Amount, *transaction.CounterpartyId); err != nil {
+		return nil, err
+	}
+
+	fromId, err := walletAccountId(tx, transaction.UserId)
+	if err != nil {
+		return nil, err
+	}
+	toId, err := walletAccountId(tx, *transaction.CounterpartyId)
+	if err != nil {
+		return nil, err
+	}
+	if err := postMovement(tx, &transaction.TransactionId, "TRANSFER", fromId, toId, transaction.Amount); err != nil {
+		return nil, err
+	}
+
+	transaction.Status = "SUCCEEDED"
+
+	return transaction, nil
+}
+
+// lockBalances locks the main balance rows of the given users in UUID order,
+// so two transfers between the same wallets in opposite directions cannot
+// deadlock.
+func lockBalances(tx *sql.Tx, userIds ...uuid.UUID) error {
+	ordered := append([]uuid.UUID(nil), userIds...)
+	slices.SortFunc(ordered, func(a, b uuid.UUID) int {
+		return bytes.Compare(a[:], b[:])
+	})
+
+	queryRead := `SELECT 1 FROM balances WHERE user_id = $1 FOR UPDATE`
+	for _, userId := range ordered {
+		var locked int
+		if err := tx.QueryRow(queryRead, userId).Scan(&locked); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrRecipientNotFound
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
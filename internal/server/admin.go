@@ -0,0 +1,455 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+	"github.com/minh20051202/ticket-system-backend/internal/usage"
+)
+
+var authStyles = map[string]bool{
+	"NONE":   true,
+	"HEADER": true,
+	"QUERY":  true,
+	"BEARER": true,
+}
+
+func (s *APIServer) handleProviders(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		return s.handleGetProviders(w, r)
+	}
+	if r.Method == "POST" {
+		return s.handleCreateProvider(w, r)
+	}
+	return fmt.Errorf("method not allowed: %s", r.Method)
+}
+
+func (s *APIServer) handleGetProviders(w http.ResponseWriter, r *http.Request) error {
+	providers, err := s.storage.GetAllProviders()
+
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, providers)
+}
+
+func (s *APIServer) handleCreateProvider(w http.ResponseWriter, r *http.Request) error {
+	createProviderReq := new(CreateProviderRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(createProviderReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if createProviderReq.Name == "" {
+		return fmt.Errorf("provider name is required")
+	}
+
+	if _, err := url.ParseRequestURI(createProviderReq.BaseURL); err != nil {
+		return fmt.Errorf("invalid base url: %w", err)
+	}
+
+	authStyle := strings.ToUpper(createProviderReq.AuthStyle)
+	if authStyle == "" {
+		authStyle = "NONE"
+	}
+	if !authStyles[authStyle] {
+		return fmt.Errorf("invalid auth style, must be NONE, HEADER, QUERY or BEARER")
+	}
+	if (authStyle == "HEADER" || authStyle == "QUERY") && createProviderReq.AuthParam == "" {
+		return fmt.Errorf("auth param is required for %s auth style", authStyle)
+	}
+
+	usageFormat := strings.ToUpper(createProviderReq.UsageFormat)
+	if usageFormat != "" {
+		if _, ok := usage.Get(usageFormat); !ok {
+			return fmt.Errorf("unknown usage format: %s", createProviderReq.UsageFormat)
+		}
+	}
+
+	provider := &shared.Provider{
+		ProviderId:  uuid.New(),
+		Name:        createProviderReq.Name,
+		BaseURL:     strings.TrimRight(createProviderReq.BaseURL, "/"),
+		AuthStyle:   authStyle,
+		AuthParam:   createProviderReq.AuthParam,
+		UsageFormat: usageFormat,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	if err := s.storage.CreateProvider(provider); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, provider)
+}
+
+func (s *APIServer) handleProviderServices(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		return s.handleGetProviderServices(w, r)
+	}
+	if r.Method == "POST" {
+		return s.handleUpsertProviderService(w, r)
+	}
+	return fmt.Errorf("method not allowed: %s", r.Method)
+}
+
+func (s *APIServer) handleGetProviderServices(w http.ResponseWriter, r *http.Request) error {
+	services, err := s.storage.GetServicesByProvider(mux.Vars(r)["provider"])
+
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, services)
+}
+
+func (s *APIServer) handleUpsertProviderService(w http.ResponseWriter, r *http.Request) error {
+	serviceReq := new(UpsertProviderServiceRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(serviceReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if serviceReq.Name == "" {
+		return fmt.Errorf("service name is required")
+	}
+
+	provider, err := s.storage.GetProviderByName(mux.Vars(r)["provider"])
+
+	if err != nil {
+		if errors.Is(err, db.ErrProviderNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	path := serviceReq.Path
+	if path == "" {
+		path = serviceReq.Name
+	}
+
+	service, err := s.storage.UpsertProviderService(&shared.ProviderService{
+		ServiceId:        uuid.New(),
+		ProviderId:       provider.ProviderId,
+		Name:             serviceReq.Name,
+		Path:             "/" + strings.TrimLeft(path, "/"),
+		Price:            serviceReq.Price,
+		MaxPrice:         serviceReq.MaxPrice,
+		InputTokenPrice:  serviceReq.InputTokenPrice,
+		OutputTokenPrice: serviceReq.OutputTokenPrice,
+		CreatedAt:        time.Now().UTC(),
+	})
+
+	if err != nil {
+		if errors.Is(err, db.ErrAmountNotGreaterThanZero) {
+			return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "price not greater than 0"})
+		}
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, service)
+}
+
+func (s *APIServer) handleProviderSecrets(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		return s.handleGetProviderSecrets(w, r)
+	}
+	if r.Method == "POST" {
+		return s.handleCreateProviderSecret(w, r)
+	}
+	return fmt.Errorf("method not allowed: %s", r.Method)
+}
+
+func (s *APIServer) handleGetProviderSecrets(w http.ResponseWriter, r *http.Request) error {
+	provider, err := s.storage.GetProviderByName(mux.Vars(r)["provider"])
+
+	if err != nil {
+		if errors.Is(err, db.ErrProviderNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	secrets, err := s.storage.GetProviderSecrets(provider.ProviderId)
+
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, secrets)
+}
+
+func (s *APIServer) handleCreateProviderSecret(w http.ResponseWriter, r *http.Request) error {
+	secretReq := new(CreateProviderSecretRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(secretReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if len(secretReq.Secret) < 8 {
+		return fmt.Errorf("secret must be at least 8 characters")
+	}
+
+	provider, err := s.storage.GetProviderByName(mux.Vars(r)["provider"])
+
+	if err != nil {
+		if errors.Is(err, db.ErrProviderNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	secretId := uuid.New()
+	ciphertext, err := s.vault.Encrypt([]byte(secretReq.Secret), secretId[:])
+
+	if err != nil {
+		return err
+	}
+
+	secret := &shared.ProviderSecret{
+		SecretId:   secretId,
+		ProviderId: provider.ProviderId,
+		Ciphertext: ciphertext,
+		Hint:       secretReq.Secret[len(secretReq.Secret)-4:],
+		Status:     "ACTIVE",
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	if err := s.storage.CreateProviderSecret(secret); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, secret)
+}
+
+func (s *APIServer) handleRetireProviderSecret(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "DELETE" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	secretId, err := uuid.Parse(mux.Vars(r)["id"])
+
+	if err != nil {
+		return fmt.Errorf("Invalid uuid given %s", mux.Vars(r)["id"])
+	}
+
+	provider, err := s.storage.GetProviderByName(mux.Vars(r)["provider"])
+
+	if err != nil {
+		if errors.Is(err, db.ErrProviderNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	if err := s.storage.RetireProviderSecret(provider.ProviderId, secretId); err != nil {
+		if errors.Is(err, db.ErrSecretNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, secretId)
+}
+
+func (s *APIServer) handleRefundTransaction(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	transactionId, err := getUUID(r)
+
+	if err != nil {
+		return err
+	}
+
+	refund, err := s.storage.Refund(transactionId)
+
+	if err != nil {
+		if errors.Is(err, db.ErrTransactionNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		} else if errors.Is(err, db.ErrNotRefundable) || errors.Is(err, db.ErrHoldNotCaptured) {
+			return WriteJSON(w, http.StatusConflict, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, refund)
+}
+
+func (s *APIServer) handleJournal(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	transactionId, err := getUUID(r)
+
+	if err != nil {
+		return err
+	}
+
+	entries, err := s.storage.GetJournalEntries(transactionId)
+
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, entries)
+}
+
+func (s *APIServer) handleWalletLedger(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	userId, err := getUUID(r)
+
+	if err != nil {
+		return err
+	}
+
+	wallet, err := s.storage.GetWalletLedger(userId)
+
+	if err != nil {
+		if errors.Is(err, db.ErrAccountNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, wallet)
+}
+
+// handleGrantPromoCredit credits a wallet from the promo account.
+func (s *APIServer) handleGrantPromoCredit(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	userId, err := getUUID(r)
+
+	if err != nil {
+		return err
+	}
+
+	promoReq := new(CreatePromoCreditRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(promoReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if promoReq.IdempotencyKey == "" {
+		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "idempotencyKey is required"})
+	}
+
+	tx, err := s.storage.Deposit(&shared.Transaction{
+		TransactionId:  uuid.New(),
+		UserId:         userId,
+		IdempotencyKey: promoReq.IdempotencyKey,
+		Amount:         promoReq.Amount,
+		Type:           "PROMO",
+		CreatedAt:      time.Now().UTC(),
+	})
+
+	if err != nil {
+		return writeChargeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, tx)
+}
+
+// handleBalanceShards switches a wallet between a single balance row and
+// sharded mode. A count of 0 turns sharding off.
+func (s *APIServer) handleBalanceShards(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "PUT" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	userId, err := getUUID(r)
+
+	if err != nil {
+		return err
+	}
+
+	shardsReq := new(SetBalanceShardsRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(shardsReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if err := s.storage.SetBalanceShards(userId, shardsReq.Count); err != nil {
+		return err
+	}
+
+	balance, err := s.storage.GetBalanceById(userId)
+
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, balance)
+}
+
+// handleReleaseExpiredLease hands the unspent rest of an expired balance
+// lease back to its wallet. Reconciliation reports such leases; release one
+// only once the charges its process acknowledged are accounted for.
+func (s *APIServer) handleReleaseExpiredLease(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	leaseId, err := getUUID(r)
+
+	if err != nil {
+		return err
+	}
+
+	lease, err := s.storage.ReleaseExpiredLease(leaseId)
+
+	if err != nil {
+		if errors.Is(err, db.ErrLeaseNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		} else if errors.Is(err, db.ErrLeaseNotExpired) || errors.Is(err, db.ErrLeaseClosed) {
+			return WriteJSON(w, http.StatusConflict, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, lease)
+}
+
+func (s *APIServer) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]any{
+		"balanceStrategy":    s.storage.BalanceStrategy(),
+		"idempotencySweeper": s.sweeper.Stats(),
+		"auditLog":           s.auditor.Stats(),
+		"settlement":         s.settlement.Stats(),
+		"shardRebalancer":    s.rebalancer.Stats(),
+		"chargeBatcher":      s.batcher.Stats(),
+		"leaseCache":         s.leases.Stats(),
+	})
+}
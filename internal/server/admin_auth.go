@@ -0,0 +1,26 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+
+	_ "github.com/joho/godotenv/autoload"
+)
+
+const AdminKeyHeader string = "X-Admin-Key"
+
+var adminSecretKey = os.Getenv("ADMIN_SECRET_KEY")
+
+func withAdminAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(AdminKeyHeader)
+
+		if adminSecretKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(adminSecretKey)) != 1 {
+			WriteJSON(w, http.StatusForbidden, ApiError{Error: "permission denied"})
+			return
+		}
+
+		handlerFunc(w, r)
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const ApiKeyHeader string = "Asymptotic-Key"
+
+func (s *APIServer) withApiKeyAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := apiKeyFromRequest(r)
+
+		if key == "" {
+			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "missing API key"})
+			return
+		}
+
+		apiKey, err := s.storage.GetApiKeyByHash(hashApiKey(key))
+
+		if err != nil {
+			WriteJSON(w, http.StatusForbidden, ApiError{Error: "permission denied"})
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, apiKey.UserId)
+		ctx = context.WithValue(ctx, apiKeyContextKey, apiKey.ApiKeyId)
+		ctx = context.WithValue(ctx, scopeContextKey, &apiKey.Scope)
+		// Organization keys bill the organization's wallet, and the member
+		// who issued the key is recorded alongside.
+		ctx = context.WithValue(ctx, memberContextKey, apiKey.MemberId)
+
+		r = r.WithContext(ctx)
+
+		handlerFunc(w, r)
+	}
+}
+
+// apiKeyFromRequest accepts the key either in the Asymptotic-Key header or as
+// an asym_sk_ bearer token, so agents written against OpenAI-style SDKs can
+// point their base URL at the gateway unchanged.
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get(ApiKeyHeader); key != "" {
+		return key
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && strings.HasPrefix(token, PREFIX) {
+		return token
+	}
+
+	return ""
+}
+
+func hashApiKey(key string) string {
+	hashedKey := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hashedKey[:])
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+const RequestIdHeader string = "X-Request-Id"
+
+const (
+	defaultAuditQueueSize = 10000
+	defaultAuditWorkers   = 4
+	auditBatchSize        = 100
+	auditFlushInterval    = time.Second
+)
+
+var auditQueueSize = os.Getenv("AUDIT_QUEUE_SIZE")
+var auditWorkers = os.Getenv("AUDIT_WORKERS")
+
+// AuditStats reports the state of the audit log queue.
+type AuditStats struct {
+	QueueDepth    int   `json:"queueDepth"`
+	QueueCapacity int   `json:"queueCapacity"`
+	Written       int64 `json:"written"`
+	Dropped       int64 `json:"dropped"`
+	Failed        int64 `json:"failed"`
+}
+
+// auditLogger writes audit entries to Postgres from a pool of workers. Log
+// never blocks: when the queue is full the entry is dropped and counted, so a
+// slow database cannot hold up proxied traffic.
+type auditLogger struct {
+	storage db.Storage
+	queue   chan *shared.AuditEntry
+	wg      sync.WaitGroup
+
+	// mu guards closed so that Log never sends on a closed queue.
+	mu     sync.RWMutex
+	closed bool
+
+	written atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+func newAuditLogger(storage db.Storage) *auditLogger {
+	return &auditLogger{
+		storage: storage,
+		queue:   make(chan *shared.AuditEntry, parseIntOr(auditQueueSize, defaultAuditQueueSize)),
+	}
+}
+
+func (a *auditLogger) start() {
+	for range parseIntOr(auditWorkers, defaultAuditWorkers) {
+		a.wg.Add(1)
+		go a.work()
+	}
+}
+
+func (a *auditLogger) Log(entry *shared.AuditEntry) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		a.dropped.Add(1)
+		return
+	}
+
+	select {
+	case a.queue <- entry:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// Close stops accepting entries and waits until the workers have written
+// everything still queued. Entries logged after Close are dropped.
+func (a *auditLogger) Close() {
+	a.mu.Lock()
+	a.closed = true
+	close(a.queue)
+	a.mu.Unlock()
+
+	a.wg.Wait()
+}
+
+func (a *auditLogger) work() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*shared.AuditEntry, 0, auditBatchSize)
+	for {
+		select {
+		case entry, ok := <-a.queue:
+			if !ok {
+				a.flush(batch)
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) == auditBatchSize {
+				a.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			a.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (a *auditLogger) flush(batch []*shared.AuditEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := a.storage.InsertAuditEntries(batch); err != nil {
+		a.failed.Add(int64(len(batch)))
+		log.Printf("failed to write %d audit entries: %v", len(batch), err)
+		return
+	}
+	a.written.Add(int64(len(batch)))
+}
+
+func (a *auditLogger) Stats() AuditStats {
+	return AuditStats{
+		QueueDepth:    len(a.queue),
+		QueueCapacity: cap(a.queue),
+		Written:       a.written.Load(),
+		Dropped:       a.dropped.Load(),
+		Failed:        a.failed.Load(),
+	}
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(statusCode int) {
+	if !rec.wroteHeader {
+		rec.statusCode = statusCode
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func parseIntOr(value string, fallback int) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return fallback
+	}
+	return n
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+const defaultChargeBatchSize = 100
+
+var chargeBatchWindow = os.Getenv("CHARGE_BATCH_WINDOW")
+var chargeBatchSize = os.Getenv("CHARGE_BATCH_SIZE")
+
+// BatcherStats reports how charges have been grouped since the server
+// started.
+type BatcherStats struct {
+	Enabled  bool   `json:"enabled"`
+	Window   string `json:"window"`
+	Batches  int64  `json:"batches"`
+	Charges  int64  `json:"charges"`
+	Largest  int64  `json:"largest"`
+	Failures int64  `json:"failures"`
+}
+
+// chargeBatcher group-commits charges. Charges for the same wallet that
+// arrive within one window are applied together by ChargeBatch, which locks
+// the wallet once per batch rather than once per charge. Each caller still
+// gets its own result. A batch is applied early once it reaches the maximum
+// size. With no window configured, charges go straight to Charge.
+type chargeBatcher struct {
+	storage db.Storage
+	window  time.Duration
+	maxSize int
+
+	mu      sync.Mutex
+	pending map[uuid.UUID]*chargeBatch
+
+	batches  atomic.Int64
+	charges  atomic.Int64
+	largest  atomic.Int64
+	failures atomic.Int64
+}
+
+type chargeBatch struct {
+	requests []*chargeRequest
+}
+
+type chargeRequest struct {
+	transaction *shared.Transaction
+	done        chan chargeResult
+}
+
+type chargeResult struct {
+	transaction *shared.Transaction
+	err         error
+}
+
+func newChargeBatcher(storage db.Storage) *chargeBatcher {
+	return &chargeBatcher{
+		storage: storage,
+		window:  parseDurationOr(chargeBatchWindow, 0),
+		maxSize: parseIntOr(chargeBatchSize, defaultChargeBatchSize),
+		pending: make(map[uuid.UUID]*chargeBatch),
+	}
+}
+
+// Charge applies the charge, batched with other charges for the same wallet,
+// and waits for its result.
+func (b *chargeBatcher) Charge(transaction *shared.Transaction) (*shared.Transaction, error) {
+	if b.window <= 0 {
+		return b.storage.Charge(transaction)
+	}
+
+	request := &chargeRequest{transaction: transaction, done: make(chan chargeResult, 1)}
+
+	b.mu.Lock()
+	batch, ok := b.pending[transaction.UserId]
+	if !ok {
+		batch = &chargeBatch{}
+		b.pending[transaction.UserId] = batch
+		time.AfterFunc(b.window, func() { b.flush(transaction.UserId, batch) })
+	}
+	batch.requests = append(batch.requests, request)
+	full := len(batch.requests) >= b.maxSize
+	if full {
+		delete(b.pending, transaction.UserId)
+	}
+	b.mu.Unlock()
+
+	if full {
+		b.apply(batch)
+	}
+
+	result := <-request.done
+	return result.transaction, result.err
+}
+
+// flush applies the wallet's batch when its window closes, unless it was
+// already applied for being full.
+func (b *chargeBatcher) flush(userId uuid.UUID, batch *chargeBatch) {
+	b.mu.Lock()
+	if b.pending[userId] != batch {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, userId)
+	b.mu.Unlock()
+
+	b.apply(batch)
+}
+
+func (b *chargeBatcher) apply(batch *chargeBatch) {
+	transactions := make([]*shared.Transaction, len(batch.requests))
+	for i, request := range batch.requests {
+		transactions[i] = request.transaction
+	}
+
+	size := int64(len(transactions))
+	b.batches.Add(1)
+	b.charges.Add(size)
+	for {
+		largest := b.largest.Load()
+		if size <= largest || b.largest.CompareAndSwap(largest, size) {
+			break
+		}
+	}
+
+	results, errs, err := b.storage.ChargeBatch(transactions)
+	if err != nil {
+		b.failures.Add(1)
+	}
+
+	for i, request := range batch.requests {
+		if err != nil {
+			request.done <- chargeResult{err: err}
+			continue
+		}
+		request.done <- chargeResult{transaction: results[i], err: errs[i]}
+	}
+}
+
+func (b *chargeBatcher) Stats() BatcherStats {
+	return BatcherStats{
+		Enabled:  b.window > 0,
+		Window:   b.window.String(),
+		Batches:  b.batches.Load(),
+		Charges:  b.charges.Load(),
+		Largest:  b.largest.Load(),
+		Failures: b.failures.Load(),
+	}
+}
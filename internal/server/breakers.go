@@ -0,0 +1,345 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerWindow         = 30 * time.Second
+	defaultBreakerMinCalls       = 20
+	defaultBreakerErrorPercent   = 50
+	defaultBreakerSlowCall       = 10 * time.Second
+	defaultBreakerOpenDuration   = 30 * time.Second
+	defaultBreakerHalfOpenProbes = 3
+	breakerBuckets               = 10
+)
+
+var breakerWindow = os.Getenv("BREAKER_WINDOW")
+var breakerMinCalls = os.Getenv("BREAKER_MIN_CALLS")
+var breakerErrorPercent = os.Getenv("BREAKER_ERROR_PERCENT")
+var breakerSlowCall = os.Getenv("BREAKER_SLOW_CALL")
+var breakerOpenDuration = os.Getenv("BREAKER_OPEN_DURATION")
+var breakerHalfOpenProbes = os.Getenv("BREAKER_HALF_OPEN_PROBES")
+
+const (
+	breakerClosed   = "CLOSED"
+	breakerOpen     = "OPEN"
+	breakerHalfOpen = "HALF_OPEN"
+)
+
+// ProviderHealth reports a provider's circuit breaker and the calls it has
+// seen in its current window.
+type ProviderHealth struct {
+	Provider      string     `json:"provider"`
+	State         string     `json:"state"`
+	Calls         int64      `json:"calls"`
+	Failures      int64      `json:"failures"`
+	SlowCalls     int64      `json:"slowCalls"`
+	ErrorPercent  int64      `json:"errorPercent"`
+	AvgLatencyMs  int64      `json:"avgLatencyMs"`
+	Trips         int64      `json:"trips"`
+	Rejected      int64      `json:"rejected"`
+	OpenedAt      *time.Time `json:"openedAt"`
+	RetryAt       *time.Time `json:"retryAt"`
+	LastFailureAt *time.Time `json:"lastFailureAt"`
+}
+
+// breakerConfig holds the thresholds shared by every provider's breaker.
+type breakerConfig struct {
+	window         time.Duration
+	minCalls       int64
+	errorPercent   int64
+	slowCall       time.Duration
+	openDuration   time.Duration
+	halfOpenProbes int
+}
+
+// breakerRegistry keeps one circuit breaker per provider. Breakers live in
+// memory, so each gateway process judges its providers on its own traffic.
+type breakerRegistry struct {
+	config breakerConfig
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newBreakerRegistry() *breakerRegistry {
+	return &breakerRegistry{
+		config: breakerConfig{
+			window:         parseDurationOr(breakerWindow, defaultBreakerWindow),
+			minCalls:       int64(parseIntOr(breakerMinCalls, defaultBreakerMinCalls)),
+			errorPercent:   int64(min(parseIntOr(breakerErrorPercent, defaultBreakerErrorPercent), 100)),
+			slowCall:       parseDurationOr(breakerSlowCall, defaultBreakerSlowCall),
+			openDuration:   parseDurationOr(breakerOpenDuration, defaultBreakerOpenDuration),
+			halfOpenProbes: parseIntOr(breakerHalfOpenProbes, defaultBreakerHalfOpenProbes),
+		},
+		breakers: make(map[string]*circuitBreaker),
+	}
+}
+
+func (br *breakerRegistry) get(provider string) *circuitBreaker {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	cb, ok := br.breakers[provider]
+	if !ok {
+		cb = &circuitBreaker{provider: provider, config: &br.config, state: breakerClosed}
+		br.breakers[provider] = cb
+	}
+	return cb
+}
+
+// Health reports every provider that has been called since the server
+// started, ordered by name.
+func (br *breakerRegistry) Health() []ProviderHealth {
+	br.mu.Lock()
+	breakers := make([]*circuitBreaker, 0, len(br.breakers))
+	for _, cb := range br.breakers {
+		breakers = append(breakers, cb)
+	}
+	br.mu.Unlock()
+
+	sort.Slice(breakers, func(i, j int) bool { return breakers[i].provider < breakers[j].provider })
+
+	health := make([]ProviderHealth, 0, len(breakers))
+	for _, cb := range breakers {
+		health = append(health, cb.health())
+	}
+	return health
+}
+
+// breakerBucket counts the calls finished in one slice of the window.
+type breakerBucket struct {
+	start     time.Time
+	calls     int64
+	failures  int64
+	slowCalls int64
+	latency   time.Duration
+}
+
+// circuitBreaker stops calls to a failing provider before they are charged.
+//
+// While closed it counts calls over a rolling window; a call fails when the
+// provider cannot be reached, times out or answers 500 or above, and a
+// successful call slower than the slow-call threshold counts against it too.
+// Once the window has enough calls and those two reach the error percentage,
+// the breaker opens and rejects every call. After the open duration it lets a
+// few probe calls through: if they all succeed it closes again, and the first
+// one that fails opens it for another round.
+type circuitBreaker struct {
+	provider string
+	config   *breakerConfig
+
+	mu      sync.Mutex
+	state   string
+	buckets [breakerBuckets]breakerBucket
+	// generation changes with every state change, so calls admitted under an
+	// earlier state do not count towards the current one.
+	generation    int64
+	probes        int
+	probesPassed  int
+	trips         int64
+	rejected      int64
+	openedAt      time.Time
+	lastFailureAt time.Time
+}
+
+// breakerAttempt is one call let through by a breaker. Exactly one of record
+// or release takes effect; release after record does nothing, so it can be
+// deferred.
+type breakerAttempt struct {
+	cb         *circuitBreaker
+	generation int64
+	probe      bool
+	done       bool
+}
+
+// allow reports whether a call may go to the provider, and if not, how long
+// until the breaker lets probes through.
+func (cb *circuitBreaker) allow() (*breakerAttempt, time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	if cb.state == breakerOpen {
+		if wait := cb.openedAt.Add(cb.config.openDuration).Sub(now); wait > 0 {
+			cb.rejected++
+			return nil, wait
+		}
+		cb.transition(breakerHalfOpen)
+	}
+
+	if cb.state == breakerHalfOpen {
+		if cb.probes >= cb.config.halfOpenProbes {
+			cb.rejected++
+			return nil, time.Second
+		}
+		cb.probes++
+		return &breakerAttempt{cb: cb, generation: cb.generation, probe: true}, 0
+	}
+
+	return &breakerAttempt{cb: cb, generation: cb.generation}, 0
+}
+
+// record reports how the provider handled the call.
+func (a *breakerAttempt) record(failed bool, latency time.Duration) {
+	if a.done {
+		return
+	}
+	a.done = true
+
+	cb := a.cb
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	slow := latency >= cb.config.slowCall
+	if failed || slow {
+		cb.lastFailureAt = now
+	}
+	if a.generation != cb.generation {
+		return
+	}
+
+	if a.probe {
+		if failed || slow {
+			cb.trip(now)
+			return
+		}
+		cb.probesPassed++
+		if cb.probesPassed >= cb.config.halfOpenProbes {
+			cb.transition(breakerClosed)
+		}
+		return
+	}
+
+	bucket := cb.bucket(now)
+	bucket.calls++
+	bucket.latency += latency
+	if failed {
+		bucket.failures++
+	} else if slow {
+		bucket.slowCalls++
+	}
+
+	calls, failures, slowCalls, _ := cb.totals(now)
+	if calls >= cb.config.minCalls && (failures+slowCalls)*100 >= cb.config.errorPercent*calls {
+		cb.trip(now)
+	}
+}
+
+// release gives back a call that never reached the provider, so that it
+// neither counts nor uses up a probe.
+func (a *breakerAttempt) release() {
+	if a.done {
+		return
+	}
+	a.done = true
+
+	cb := a.cb
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if a.probe && a.generation == cb.generation {
+		cb.probes--
+	}
+}
+
+// trip opens the breaker. The caller must hold cb.mu.
+func (cb *circuitBreaker) trip(now time.Time) {
+	cb.transition(breakerOpen)
+	cb.openedAt = now
+	cb.trips++
+}
+
+// transition moves the breaker to state and starts it afresh. The caller
+// must hold cb.mu.
+func (cb *circuitBreaker) transition(state string) {
+	cb.state = state
+	cb.generation++
+	cb.probes = 0
+	cb.probesPassed = 0
+	cb.buckets = [breakerBuckets]breakerBucket{}
+}
+
+// bucket returns the bucket for now, clearing it if it last held an older
+// slice of the window. The caller must hold cb.mu.
+func (cb *circuitBreaker) bucket(now time.Time) *breakerBucket {
+	width := cb.config.window / breakerBuckets
+	start := now.Truncate(width)
+	bucket := &cb.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+// totals sums the buckets still inside the window. The caller must hold
+// cb.mu.
+func (cb *circuitBreaker) totals(now time.Time) (int64, int64, int64, time.Duration) {
+	var calls, failures, slowCalls int64
+	var latency time.Duration
+	for _, bucket := range cb.buckets {
+		if now.Sub(bucket.start) >= cb.config.window {
+			continue
+		}
+		calls += bucket.calls
+		failures += bucket.failures
+		slowCalls += bucket.slowCalls
+		latency += bucket.latency
+	}
+	return calls, failures, slowCalls, latency
+}
+
+func (cb *circuitBreaker) health() ProviderHealth {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	calls, failures, slowCalls, latency := cb.totals(now)
+	health := ProviderHealth{
+		Provider:  cb.provider,
+		State:     cb.state,
+		Calls:     calls,
+		Failures:  failures,
+		SlowCalls: slowCalls,
+		Trips:     cb.trips,
+		Rejected:  cb.rejected,
+	}
+	if calls > 0 {
+		health.ErrorPercent = (failures + slowCalls) * 100 / calls
+		health.AvgLatencyMs = (latency / time.Duration(calls)).Milliseconds()
+	}
+	if !cb.openedAt.IsZero() {
+		openedAt := cb.openedAt.UTC()
+		health.OpenedAt = &openedAt
+	}
+	if cb.state == breakerOpen {
+		retryAt := cb.openedAt.Add(cb.config.openDuration).UTC()
+		health.RetryAt = &retryAt
+	}
+	if !cb.lastFailureAt.IsZero() {
+		lastFailureAt := cb.lastFailureAt.UTC()
+		health.LastFailureAt = &lastFailureAt
+	}
+	return health
+}
+
+func writeCircuitOpen(w http.ResponseWriter, retryAfter time.Duration) error {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	return WriteJSON(w, http.StatusServiceUnavailable, ApiError{Error: "provider is unavailable, try again later"})
+}
+
+func (s *APIServer) handleBreakers(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+	return WriteJSON(w, http.StatusOK, s.breakers.Health())
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+func (s *APIServer) handleCreateHold(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	createHoldReq := new(CreateHoldRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(createHoldReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	hold, err := s.storage.Authorize(&shared.Transaction{
+		TransactionId:  uuid.New(),
+		UserId:         userId,
+		IdempotencyKey: createHoldReq.IdempotencyKey,
+		Amount:         createHoldReq.Amount,
+		Type:           "CHARGE",
+		CreatedAt:      time.Now().UTC(),
+	}, createHoldReq.MaxAmount)
+
+	if err != nil {
+		return writeChargeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, hold)
+}
+
+func (s *APIServer) handleCaptureHold(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	hold, err := s.getOwnHold(r)
+
+	if err != nil {
+		return writeHoldError(w, err)
+	}
+
+	captureReq := new(CaptureHoldRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(captureReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	hold, err = s.storage.Capture(hold.TransactionId, captureReq.Amount)
+
+	if err != nil {
+		return writeHoldError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, hold)
+}
+
+func (s *APIServer) handleVoidHold(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	hold, err := s.getOwnHold(r)
+
+	if err != nil {
+		return writeHoldError(w, err)
+	}
+
+	hold, err = s.storage.Void(hold.TransactionId)
+
+	if err != nil {
+		return writeHoldError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, hold)
+}
+
+// getOwnHold loads the hold named in the URL, hiding holds that belong to
+// other users behind ErrHoldNotFound.
+func (s *APIServer) getOwnHold(r *http.Request) (*shared.Hold, error) {
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	holdId, err := getUUID(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hold, err := s.storage.GetHoldById(holdId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if hold.UserId != userId {
+		return nil, db.ErrHoldNotFound
+	}
+
+	return hold, nil
+}
+
+func writeHoldError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, db.ErrHoldNotFound) {
+		return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+	} else if errors.Is(err, db.ErrHoldClosed) {
+		return WriteJSON(w, http.StatusConflict, ApiError{Error: err.Error()})
+	} else if errors.Is(err, db.ErrCaptureExceedsCap) || errors.Is(err, db.ErrInvalidCaptureAmount) {
+		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+	}
+	return writeChargeError(w, err)
+}
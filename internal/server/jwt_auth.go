@@ -15,6 +15,9 @@ import (
 type contextKey string
 
 const userContextKey contextKey = "userId"
+const apiKeyContextKey contextKey = "apiKeyId"
+const scopeContextKey contextKey = "apiKeyScope"
+const memberContextKey contextKey = "memberId"
 
 var jwtSecretKey = os.Getenv("JWT_SECRET_KEY")
 
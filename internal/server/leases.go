@@ -0,0 +1,386 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+const defaultLeaseTTL = time.Minute
+
+const defaultLeaseFlushInterval = time.Second
+
+var leaseSize = os.Getenv("LEASE_SIZE")
+var leaseTTL = os.Getenv("LEASE_TTL")
+var leaseFlushInterval = os.Getenv("LEASE_FLUSH_INTERVAL")
+
+// LeaseStats reports what the lease cache has done since the server started.
+type LeaseStats struct {
+	Enabled         bool  `json:"enabled"`
+	ActiveLeases    int   `json:"activeLeases"`
+	Acquired        int64 `json:"acquired"`
+	Released        int64 `json:"released"`
+	Lost            int64 `json:"lost"`
+	ChargesInMemory int64 `json:"chargesInMemory"`
+	ChargesFlushed  int64 `json:"chargesFlushed"`
+	Duplicates      int64 `json:"duplicates"`
+	Rejected        int64 `json:"rejected"`
+	Fallbacks       int64 `json:"fallbacks"`
+	Expired         int64 `json:"expired"`
+	FlushFailures   int64 `json:"flushFailures"`
+}
+
+// leaseCache answers direct charges, those made through POST /transaction,
+// from balance leases held in memory, so they skip the locking transaction
+// Charge runs. A charge that the wallet's lease cannot cover makes the cache
+// release it and take a new one; if the wallet cannot be leased, the charge
+// goes to the next charger instead. Charges are recorded in the database when
+// the cache flushes, which also renews the lease, and a lease left idle for
+// half its TTL is released.
+//
+// Proxied calls do not go through the cache: they reserve a hold in the
+// database, because capturing, voiding and settling it, and the API key's
+// budget, all work on that row.
+//
+// Taking a lease loads the wallet's live idempotency keys, so a retry is
+// answered from memory with the stored charge even if it was made before the
+// lease; only a charge that finds no lease reads the database. A key used
+// elsewhere after the lease was taken, or sent to two processes at once, can
+// still be acknowledged twice; only one charge is recorded and the other is
+// counted as a duplicate when it is flushed.
+type leaseCache struct {
+	storage  db.Storage
+	next     func(*shared.Transaction) (*shared.Transaction, error)
+	size     int64
+	ttl      time.Duration
+	interval time.Duration
+
+	mu      sync.Mutex
+	wallets map[uuid.UUID]*walletLease
+
+	acquired        atomic.Int64
+	released        atomic.Int64
+	lost            atomic.Int64
+	chargesInMemory atomic.Int64
+	chargesFlushed  atomic.Int64
+	duplicates      atomic.Int64
+	rejected        atomic.Int64
+	fallbacks       atomic.Int64
+	expired         atomic.Int64
+	flushFailures   atomic.Int64
+}
+
+// errWalletLeaseRemoved is returned for a walletLease that was taken out of
+// the cache while a charge waited for it.
+var errWalletLeaseRemoved = errors.New("wallet lease removed from the cache")
+
+// walletLease is the lease the process holds on one wallet. mu serializes
+// charging against it with flushing and replacing it. charged holds the
+// wallet's charges by idempotency key while it has a lease.
+type walletLease struct {
+	mu        sync.Mutex
+	removed   bool
+	lease     *shared.BalanceLease
+	remaining int64
+	pending   []*shared.Transaction
+	charged   map[string]*shared.Transaction
+	lastUsed  time.Time
+}
+
+func newLeaseCache(storage db.Storage, next func(*shared.Transaction) (*shared.Transaction, error)) *leaseCache {
+	return &leaseCache{
+		storage:  storage,
+		next:     next,
+		size:     int64(parseIntOr(leaseSize, 0)),
+		ttl:      parseDurationOr(leaseTTL, defaultLeaseTTL),
+		interval: parseDurationOr(leaseFlushInterval, defaultLeaseFlushInterval),
+		wallets:  make(map[uuid.UUID]*walletLease),
+	}
+}
+
+func (lc *leaseCache) enabled() bool {
+	return lc.size > 0
+}
+
+func (lc *leaseCache) Charge(transaction *shared.Transaction) (*shared.Transaction, error) {
+	if !lc.enabled() || transaction.Amount <= 0 {
+		return lc.next(transaction)
+	}
+
+	for {
+		lc.mu.Lock()
+		wl, ok := lc.wallets[transaction.UserId]
+		if !ok {
+			wl = &walletLease{}
+			lc.wallets[transaction.UserId] = wl
+		}
+		lc.mu.Unlock()
+
+		charged, err := lc.chargeLease(wl, transaction)
+		if errors.Is(err, errWalletLeaseRemoved) {
+			continue
+		}
+		if errors.Is(err, db.ErrLeaseNotAllowed) || errors.Is(err, db.ErrInsufficientFunds) {
+			// Let the database decide, and answer, with the wallet's full balance.
+			lc.fallbacks.Add(1)
+			return lc.next(transaction)
+		}
+		return charged, err
+	}
+}
+
+func (lc *leaseCache) chargeLease(wl *walletLease, transaction *shared.Transaction) (*shared.Transaction, error) {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	if wl.removed {
+		return nil, errWalletLeaseRemoved
+	}
+
+	if wl.lease == nil {
+		if err := lc.acquire(wl, transaction); err != nil {
+			return nil, err
+		}
+	}
+
+	if earlier, ok := wl.charged[transaction.IdempotencyKey]; ok {
+		if !sameCharge(earlier, transaction) {
+			return nil, db.ErrIdempotencyKeyReused
+		}
+		return earlier, nil
+	}
+
+	// Stop charging a lease before it can expire under a flush.
+	usable := time.Until(wl.lease.ExpiresAt) > lc.interval
+	if !usable || wl.remaining < transaction.Amount {
+		if err := lc.release(wl); err != nil {
+			return nil, err
+		}
+		if err := lc.acquire(wl, transaction); err != nil {
+			return nil, err
+		}
+	}
+
+	wl.remaining -= transaction.Amount
+	wl.pending = append(wl.pending, transaction)
+	wl.charged[transaction.IdempotencyKey] = transaction
+	wl.lastUsed = time.Now().UTC()
+	transaction.Status = "PENDING"
+	lc.chargesInMemory.Add(1)
+
+	return transaction, nil
+}
+
+// acquire takes a new lease on the wallet that covers transaction, along with
+// the charges stored under the wallet's live idempotency keys, so that a key
+// used before the lease is answered from memory too. The caller must hold
+// wl.mu.
+func (lc *leaseCache) acquire(wl *walletLease, transaction *shared.Transaction) error {
+	charged, err := lc.storage.GetIdempotentTransactions(transaction.UserId)
+	if err != nil {
+		return err
+	}
+
+	lease, err := lc.storage.AcquireLease(transaction.UserId, max(lc.size, transaction.Amount), transaction.Amount, time.Now().UTC().Add(lc.ttl))
+	if err != nil {
+		return err
+	}
+	lc.acquired.Add(1)
+	wl.lease = lease
+	wl.remaining = lease.Amount
+	wl.charged = charged
+	return nil
+}
+
+// sameCharge reports whether transaction repeats earlier, comparing what the
+// database fingerprints a charge by.
+func sameCharge(earlier *shared.Transaction, transaction *shared.Transaction) bool {
+	return earlier.Type == transaction.Type &&
+		earlier.Amount == transaction.Amount &&
+		sameId(earlier.ApiKeyId, transaction.ApiKeyId) &&
+		sameId(earlier.ProviderId, transaction.ProviderId)
+}
+
+func sameId(a *uuid.UUID, b *uuid.UUID) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
+
+func (lc *leaseCache) run() {
+	if !lc.enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(lc.interval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		lc.flushAll()
+
+		// Set aside the leases of processes that stopped renewing them.
+		expired, err := lc.storage.ExpireLeases(time.Now().UTC())
+		if err != nil {
+			log.Println("failed to expire balance leases: ", err)
+		}
+		lc.expired.Add(expired)
+	}
+}
+
+// flushAll records what every lease has charged, and releases the leases
+// that have been idle for half their TTL.
+func (lc *leaseCache) flushAll() {
+	lc.mu.Lock()
+	wallets := make(map[uuid.UUID]*walletLease, len(lc.wallets))
+	for userId, wl := range lc.wallets {
+		wallets[userId] = wl
+	}
+	lc.mu.Unlock()
+
+	now := time.Now().UTC()
+	for userId, wl := range wallets {
+		wl.mu.Lock()
+		if wl.lease != nil && now.Sub(wl.lastUsed) > lc.ttl/2 {
+			lc.release(wl)
+		} else if wl.lease != nil {
+			lc.flush(wl, now.Add(lc.ttl))
+		}
+		idle := wl.lease == nil
+		wl.mu.Unlock()
+
+		if idle {
+			lc.mu.Lock()
+			wl.mu.Lock()
+			if wl.lease == nil && lc.wallets[userId] == wl {
+				delete(lc.wallets, userId)
+				wl.removed = true
+			}
+			wl.mu.Unlock()
+			lc.mu.Unlock()
+		}
+	}
+}
+
+// flush records the lease's pending charges and renews it. A lease that has
+// expired is released instead, which still records its charges. The caller
+// must hold wl.mu.
+func (lc *leaseCache) flush(wl *walletLease, renewUntil time.Time) {
+	errs, err := lc.storage.FlushLease(wl.lease.LeaseId, wl.pending, renewUntil)
+	if errors.Is(err, db.ErrLeaseExpired) {
+		lc.release(wl)
+		return
+	}
+	if err != nil {
+		lc.flushFailed(wl, err)
+		return
+	}
+	lc.settle(wl, errs)
+	wl.lease.ExpiresAt = renewUntil
+}
+
+// release records the lease's pending charges and hands the rest back to the
+// wallet. If that fails the lease is kept, with its charges, for the next
+// flush. The caller must hold wl.mu.
+func (lc *leaseCache) release(wl *walletLease) error {
+	errs, err := lc.storage.ReleaseLease(wl.lease.LeaseId, wl.pending)
+	if err != nil {
+		return lc.flushFailed(wl, err)
+	}
+	lc.settle(wl, errs)
+	lc.released.Add(1)
+	lc.drop(wl)
+	return nil
+}
+
+// settle accounts for a flush the database accepted. A charge it refused was
+// never recorded, so its money is still in the lease. Refusals other than a
+// duplicate mean a charge was acknowledged but not recorded, and are logged.
+func (lc *leaseCache) settle(wl *walletLease, errs []error) {
+	for i, charge := range wl.pending {
+		if errs[i] == nil {
+			lc.chargesFlushed.Add(1)
+			continue
+		}
+		wl.remaining += charge.Amount
+		if errors.Is(errs[i], db.ErrDuplicateCharge) {
+			lc.duplicates.Add(1)
+			continue
+		}
+		log.Printf("failed to record leased charge %v: %v", charge.TransactionId, errs[i])
+		lc.rejected.Add(1)
+	}
+	wl.pending = nil
+}
+
+func (lc *leaseCache) flushFailed(wl *walletLease, err error) error {
+	if errors.Is(err, db.ErrLeaseClosed) || errors.Is(err, db.ErrLeaseNotFound) {
+		// An operator released the lease after it expired, so its charges
+		// can no longer be recorded against it.
+		log.Printf("balance lease %v was closed with %d unrecorded charges", wl.lease.LeaseId, len(wl.pending))
+		lc.lost.Add(int64(len(wl.pending)))
+		lc.drop(wl)
+		return nil
+	}
+	log.Printf("failed to flush balance lease %v: %v", wl.lease.LeaseId, err)
+	lc.flushFailures.Add(1)
+	return err
+}
+
+func (lc *leaseCache) drop(wl *walletLease) {
+	wl.lease = nil
+	wl.remaining = 0
+	wl.pending = nil
+	wl.charged = nil
+}
+
+// Close releases every lease so that no money stays reserved after the
+// process exits. A lease that cannot be released expires and is left for
+// reconciliation.
+func (lc *leaseCache) Close() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	for userId, wl := range lc.wallets {
+		wl.mu.Lock()
+		if wl.lease != nil {
+			lc.release(wl)
+		}
+		wl.removed = true
+		wl.mu.Unlock()
+		delete(lc.wallets, userId)
+	}
+}
+
+func (lc *leaseCache) Stats() LeaseStats {
+	lc.mu.Lock()
+	active := 0
+	for _, wl := range lc.wallets {
+		wl.mu.Lock()
+		if wl.lease != nil {
+			active++
+		}
+		wl.mu.Unlock()
+	}
+	lc.mu.Unlock()
+
+	return LeaseStats{
+		Enabled:         lc.enabled(),
+		ActiveLeases:    active,
+		Acquired:        lc.acquired.Load(),
+		Released:        lc.released.Load(),
+		Lost:            lc.lost.Load(),
+		ChargesInMemory: lc.chargesInMemory.Load(),
+		ChargesFlushed:  lc.chargesFlushed.Load(),
+		Duplicates:      lc.duplicates.Load(),
+		Rejected:        lc.rejected.Load(),
+		Fallbacks:       lc.fallbacks.Load(),
+		Expired:         lc.expired.Load(),
+		FlushFailures:   lc.flushFailures.Load(),
+	}
+}
@@ -0,0 +1,447 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+// roleRanks orders organization roles. Viewers can read the organization,
+// developers can also issue API keys that bill its wallet, admins manage
+// members and every key, and owners can also manage other owners.
+var roleRanks = map[string]int{
+	"VIEWER":    1,
+	"DEVELOPER": 2,
+	"ADMIN":     3,
+	"OWNER":     4,
+}
+
+var errInsufficientRole = errors.New("your role in the organization does not allow this")
+
+func (s *APIServer) handleOrganizations(w http.ResponseWriter, r *http.Request) error {
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	if r.Method == "GET" {
+		orgs, err := s.storage.GetOrganizationsByMember(userId)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, orgs)
+	}
+	if r.Method == "POST" {
+		return s.handleCreateOrganization(w, r, userId)
+	}
+	return fmt.Errorf("method not allowed: %s", r.Method)
+}
+
+func (s *APIServer) handleCreateOrganization(w http.ResponseWriter, r *http.Request, userId uuid.UUID) error {
+	createOrgReq := new(CreateOrganizationRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(createOrgReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if createOrgReq.Name == "" || createOrgReq.BillingEmail == "" {
+		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "name and billingEmail are required"})
+	}
+
+	org := &shared.Organization{
+		OrgId:        uuid.New(),
+		Name:         createOrgReq.Name,
+		BillingEmail: createOrgReq.BillingEmail,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	if err := s.storage.CreateOrganization(org, userId); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, org)
+}
+
+func (s *APIServer) handleOrganizationById(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	orgId, err := getUUID(r)
+
+	if err != nil {
+		return err
+	}
+
+	org, err := s.storage.GetOrganization(orgId, userId)
+
+	if err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	balance, err := s.storage.GetBalanceById(orgId)
+
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, OrganizationResponse{Organization: org, Balance: balance})
+}
+
+func (s *APIServer) handleOrganizationMembers(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		orgId, _, err := s.authorizeOrganization(r, "VIEWER")
+		if err != nil {
+			return writeOrganizationError(w, err)
+		}
+
+		members, err := s.storage.GetOrganizationMembers(orgId)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, members)
+	}
+	if r.Method == "POST" {
+		return s.handleAddOrganizationMember(w, r)
+	}
+	return fmt.Errorf("method not allowed: %s", r.Method)
+}
+
+func (s *APIServer) handleAddOrganizationMember(w http.ResponseWriter, r *http.Request) error {
+	orgId, callerRole, err := s.authorizeOrganization(r, "ADMIN")
+
+	if err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	addMemberReq := new(AddOrganizationMemberRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(addMemberReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	role, err := grantableRole(callerRole, addMemberReq.Role)
+
+	if err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	if err := s.storage.AddOrganizationMember(orgId, addMemberReq.UserId, role); err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, addMemberReq.UserId)
+}
+
+func (s *APIServer) handleOrganizationMember(w http.ResponseWriter, r *http.Request) error {
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	memberId, err := uuid.Parse(mux.Vars(r)["member"])
+
+	if err != nil {
+		return fmt.Errorf("Invalid uuid given %s", mux.Vars(r)["member"])
+	}
+
+	if r.Method == "DELETE" && memberId == userId {
+		// Any member may leave, as long as an owner remains.
+		orgId, _, err := s.authorizeOrganization(r, "VIEWER")
+		if err != nil {
+			return writeOrganizationError(w, err)
+		}
+		if err := s.storage.RemoveOrganizationMember(orgId, memberId); err != nil {
+			return writeOrganizationError(w, err)
+		}
+		return WriteJSON(w, http.StatusOK, memberId)
+	}
+
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	orgId, callerRole, err := s.authorizeOrganization(r, "ADMIN")
+
+	if err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	// Only owners may change or remove another owner.
+	memberRole, err := s.storage.GetMemberRole(orgId, memberId)
+
+	if err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	if roleRanks[memberRole] > roleRanks[callerRole] {
+		return writeOrganizationError(w, errInsufficientRole)
+	}
+
+	if r.Method == "DELETE" {
+		if err := s.storage.RemoveOrganizationMember(orgId, memberId); err != nil {
+			return writeOrganizationError(w, err)
+		}
+		return WriteJSON(w, http.StatusOK, memberId)
+	}
+
+	updateMemberReq := new(UpdateOrganizationMemberRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(updateMemberReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	role, err := grantableRole(callerRole, updateMemberReq.Role)
+
+	if err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	if err := s.storage.UpdateOrganizationMemberRole(orgId, memberId, role); err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, memberId)
+}
+
+func (s *APIServer) handleOrganizationApiKeys(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		orgId, _, err := s.authorizeOrganization(r, "VIEWER")
+		if err != nil {
+			return writeOrganizationError(w, err)
+		}
+
+		apiKeys, err := s.storage.GetApiKeysByUser(orgId)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, apiKeys)
+	}
+	if r.Method == "POST" {
+		return s.handleCreateOrganizationApiKey(w, r)
+	}
+	return fmt.Errorf("method not allowed: %s", r.Method)
+}
+
+// handleCreateOrganizationApiKey issues a key that bills the organization's
+// wallet and is attributed to the member who created it.
+func (s *APIServer) handleCreateOrganizationApiKey(w http.ResponseWriter, r *http.Request) error {
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	orgId, _, err := s.authorizeOrganization(r, "DEVELOPER")
+
+	if err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	apiKeyReq := new(CreateApiKeyRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(apiKeyReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	key, apiKey, err := newApiKey(orgId, apiKeyReq.Name, apiKeyReq.ExpiresInSeconds)
+
+	if err != nil {
+		return err
+	}
+
+	apiKey.MemberId = &userId
+
+	if err := s.storage.CreateApiKey(apiKey); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, CreateApiKeyResponse{ApiKey: key, ApiKeyId: apiKey.ApiKeyId, ExpiresAt: apiKey.ExpiresAt})
+}
+
+// handleRevokeOrganizationApiKey lets developers revoke the keys they issued
+// and admins revoke any key of the organization.
+func (s *APIServer) handleRevokeOrganizationApiKey(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "DELETE" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	orgId, callerRole, err := s.authorizeOrganization(r, "DEVELOPER")
+
+	if err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	apiKeyId, err := uuid.Parse(mux.Vars(r)["id"])
+
+	if err != nil {
+		return fmt.Errorf("Invalid uuid given %s", mux.Vars(r)["id"])
+	}
+
+	return s.revokeMemberApiKey(w, orgId, apiKeyId, userId, callerRole)
+}
+
+func (s *APIServer) handleRotateOrganizationApiKey(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	orgId, apiKeyId, err := s.authorizeOrganizationApiKey(r)
+
+	if err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	return s.rotateApiKey(w, r, orgId, apiKeyId)
+}
+
+func (s *APIServer) handleOrganizationApiKeyBudget(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "PUT" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	orgId, apiKeyId, err := s.authorizeOrganizationApiKey(r)
+
+	if err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	return s.setApiKeyBudget(w, r, orgId, apiKeyId)
+}
+
+func (s *APIServer) handleOrganizationApiKeyScope(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "PUT" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	orgId, apiKeyId, err := s.authorizeOrganizationApiKey(r)
+
+	if err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	return s.setApiKeyScope(w, r, orgId, apiKeyId)
+}
+
+// authorizeOrganizationApiKey checks that the caller may manage the
+// organization key named by the request, as for revoking it, and returns the
+// organization's id and the key's.
+func (s *APIServer) authorizeOrganizationApiKey(r *http.Request) (uuid.UUID, uuid.UUID, error) {
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	orgId, callerRole, err := s.authorizeOrganization(r, "DEVELOPER")
+
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+
+	apiKeyId, err := uuid.Parse(mux.Vars(r)["id"])
+
+	if err != nil {
+		return uuid.Nil, uuid.Nil, fmt.Errorf("Invalid uuid given %s", mux.Vars(r)["id"])
+	}
+
+	if err := s.checkMemberApiKey(orgId, apiKeyId, userId, callerRole); err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+
+	return orgId, apiKeyId, nil
+}
+
+// revokeMemberApiKey revokes one of ownerId's keys on behalf of userId, who
+// holds role over it. Below admin, only keys userId issued can be revoked.
+func (s *APIServer) revokeMemberApiKey(w http.ResponseWriter, ownerId uuid.UUID, apiKeyId uuid.UUID, userId uuid.UUID, role string) error {
+	if err := s.checkMemberApiKey(ownerId, apiKeyId, userId, role); err != nil {
+		return writeOrganizationError(w, err)
+	}
+
+	if err := s.storage.RevokeApiKey(ownerId, apiKeyId); err != nil {
+		if errors.Is(err, db.ErrApiKeyNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, apiKeyId)
+}
+
+// checkMemberApiKey reports errInsufficientRole if userId, who holds role over
+// ownerId, is below admin and did not issue the key.
+func (s *APIServer) checkMemberApiKey(ownerId uuid.UUID, apiKeyId uuid.UUID, userId uuid.UUID, role string) error {
+	if roleRanks[role] >= roleRanks["ADMIN"] {
+		return nil
+	}
+
+	apiKeys, err := s.storage.GetApiKeysByUser(ownerId)
+	if err != nil {
+		return err
+	}
+	for _, apiKey := range apiKeys {
+		if apiKey.ApiKeyId == apiKeyId && (apiKey.MemberId == nil || *apiKey.MemberId != userId) {
+			return errInsufficientRole
+		}
+	}
+	return nil
+}
+
+// authorizeOrganization checks that the caller holds at least minRole in the
+// organization named by the request and returns its id and the caller's role.
+func (s *APIServer) authorizeOrganization(r *http.Request, minRole string) (uuid.UUID, string, error) {
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	orgId, err := getUUID(r)
+
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+
+	role, err := s.storage.GetMemberRole(orgId, userId)
+
+	if err != nil {
+		if errors.Is(err, db.ErrNotMember) {
+			// Non-members cannot tell whether the organization exists.
+			return uuid.Nil, "", db.ErrOrganizationNotFound
+		}
+		return uuid.Nil, "", err
+	}
+
+	if roleRanks[role] < roleRanks[minRole] {
+		return uuid.Nil, "", errInsufficientRole
+	}
+
+	return orgId, role, nil
+}
+
+// grantableRole validates a requested role. Nobody can grant a role above
+// their own.
+func grantableRole(callerRole string, requested string) (string, error) {
+	role := strings.ToUpper(requested)
+	if _, ok := roleRanks[role]; !ok {
+		return "", fmt.Errorf("invalid role %q, must be one of owner, admin, developer or viewer", requested)
+	}
+	if roleRanks[role] > roleRanks[callerRole] {
+		return "", errInsufficientRole
+	}
+	return role, nil
+}
+
+func writeOrganizationError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, db.ErrOrganizationNotFound) || errors.Is(err, db.ErrNotMember) {
+		return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+	} else if errors.Is(err, errInsufficientRole) {
+		return WriteJSON(w, http.StatusForbidden, ApiError{Error: err.Error()})
+	} else if errors.Is(err, db.ErrAlreadyMember) || errors.Is(err, db.ErrLastOwner) {
+		return WriteJSON(w, http.StatusConflict, ApiError{Error: err.Error()})
+	}
+	return WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+}
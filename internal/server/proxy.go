@@ -0,0 +1,409 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+	"github.com/minh20051202/ticket-system-backend/internal/usage"
+)
+
+const IdempotencyKeyHeader string = "X-Idempotency-Key"
+
+const defaultProxyTimeout = 30 * time.Second
+
+// defaultMaxUsageBody bounds how much of a usage-billed response is read into
+// memory to find its usage.
+const defaultMaxUsageBody = 10 << 20
+
+var proxyTimeout = os.Getenv("PROXY_TIMEOUT")
+var proxyMaxUsageBody = os.Getenv("PROXY_MAX_USAGE_BODY")
+
+var proxyMethods = map[string]bool{
+	"GET":    true,
+	"POST":   true,
+	"PUT":    true,
+	"PATCH":  true,
+	"DELETE": true,
+}
+
+// hopHeaders are connection-scoped and must not be forwarded by a proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func newProxyClient() *http.Client {
+	return &http.Client{Timeout: parseDurationOr(proxyTimeout, defaultProxyTimeout)}
+}
+
+func (s *APIServer) handleProxy(w http.ResponseWriter, r *http.Request) error {
+	if !proxyMethods[r.Method] {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	call := &proxyCall{
+		requestId: uuid.New(),
+		userId:    r.Context().Value(userContextKey).(uuid.UUID),
+		apiKeyId:  r.Context().Value(apiKeyContextKey).(uuid.UUID),
+		memberId:  r.Context().Value(memberContextKey).(*uuid.UUID),
+	}
+	w.Header().Set(RequestIdHeader, call.requestId.String())
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	err := s.serveProxy(rec, r, call)
+
+	statusCode := rec.statusCode
+	if err != nil && !rec.wroteHeader {
+		// makeHTTPHandleFunc reports the error as a bad request.
+		statusCode = http.StatusBadRequest
+	}
+	s.auditor.Log(&shared.AuditEntry{
+		RequestId:     call.requestId,
+		UserId:        call.userId,
+		ApiKeyId:      call.apiKeyId,
+		MemberId:      call.memberId,
+		Provider:      mux.Vars(r)["provider"],
+		Service:       mux.Vars(r)["service"],
+		Method:        r.Method,
+		StatusCode:    statusCode,
+		Cost:          call.cost,
+		MeteredCost:   call.meteredCost,
+		TransactionId: call.transactionId,
+		Replayed:      call.replayed,
+		DurationMs:    time.Since(start).Milliseconds(),
+		CreatedAt:     start.UTC(),
+	})
+
+	return err
+}
+
+func (s *APIServer) serveProxy(w http.ResponseWriter, r *http.Request, call *proxyCall) error {
+	scope := r.Context().Value(scopeContextKey).(*shared.ApiKeyScope)
+
+	providerName := mux.Vars(r)["provider"]
+	serviceName := mux.Vars(r)["service"]
+
+	if !scope.AllowsService(providerName, serviceName) || !scope.AllowsMethod(r.Method) {
+		return WriteJSON(w, http.StatusForbidden, ApiError{Error: "API key is not allowed to call this service"})
+	}
+
+	provider, service, err := s.storage.GetProviderService(providerName, serviceName)
+	if err != nil {
+		if errors.Is(err, db.ErrProviderNotFound) || errors.Is(err, db.ErrServiceNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	call.provider = provider
+	call.service = service
+	call.maxCost = service.MaxPrice
+
+	if scope.MaxCallCost != nil {
+		if service.Price > *scope.MaxCallCost {
+			return WriteJSON(w, http.StatusForbidden, ApiError{Error: "service price exceeds the API key's per-call limit"})
+		}
+		call.maxCost = min(call.maxCost, *scope.MaxCallCost)
+	}
+
+	if idempotencyKey := r.Header.Get(IdempotencyKeyHeader); idempotencyKey != "" {
+		return s.forwardOnce(w, r, call, idempotencyKey)
+	}
+
+	_, err = s.forward(w, r, call)
+	return err
+}
+
+type proxyCall struct {
+	requestId uuid.UUID
+	userId    uuid.UUID
+	apiKeyId  uuid.UUID
+	memberId  *uuid.UUID
+	provider  *shared.Provider
+	service   *shared.ProviderService
+	maxCost   int64
+
+	// Outcome, filled in as the call is served.
+	transactionId *uuid.UUID
+	cost          int64
+	meteredCost   *int64
+	replayed      bool
+}
+
+// forward reserves the call's price, sends the request upstream and settles
+// the hold from the outcome. It returns the hold only when the agent was
+// charged for an upstream response.
+func (s *APIServer) forward(w http.ResponseWriter, r *http.Request, call *proxyCall) (*shared.Hold, error) {
+	provider, service := call.provider, call.service
+
+	// Fail fast while the provider is down, before the agent is charged.
+	attempt, retryAfter := s.breakers.get(provider.Name).allow()
+	if attempt == nil {
+		return nil, writeCircuitOpen(w, retryAfter)
+	}
+	defer attempt.release()
+
+	// Deduplication happens in the replay cache, so every forwarded attempt
+	// gets its own ledger entry.
+	hold, err := s.storage.Authorize(&shared.Transaction{
+		TransactionId:  uuid.New(),
+		UserId:         call.userId,
+		IdempotencyKey: uuid.New().String(),
+		Amount:         service.Price,
+		Type:           "CHARGE",
+		ApiKeyId:       &call.apiKeyId,
+		ProviderId:     &provider.ProviderId,
+		MemberId:       call.memberId,
+		CreatedAt:      time.Now().UTC(),
+	}, call.maxCost)
+	if err != nil {
+		return nil, writeChargeError(w, err)
+	}
+	call.transactionId = &hold.TransactionId
+
+	outReq, err := newUpstreamRequest(r, provider.BaseURL+service.Path)
+	if err != nil {
+		s.releaseHold(hold.TransactionId)
+		return nil, err
+	}
+
+	extractor, settlesOnUsage := usage.Get(provider.UsageFormat)
+	if settlesOnUsage {
+		// Let the transport negotiate and decode compression so the usage
+		// fields can be read from the body.
+		outReq.Header.Del("Accept-Encoding")
+	}
+
+	secretId, err := s.injectProviderSecret(outReq, provider)
+	if err != nil {
+		s.releaseHold(hold.TransactionId)
+		if errors.Is(err, errNoActiveSecret) {
+			return nil, WriteJSON(w, http.StatusServiceUnavailable, ApiError{Error: "provider is not configured"})
+		}
+		return nil, WriteJSON(w, http.StatusInternalServerError, ApiError{Error: "failed to load provider credentials"})
+	}
+	if secretId != uuid.Nil {
+		if err := s.storage.RecordSecretUsage(secretId, hold.TransactionId); err != nil {
+			log.Println("failed to record secret usage: ", err)
+		}
+	}
+
+	sentAt := time.Now()
+	resp, err := s.proxyClient.Do(outReq)
+	if r.Context().Err() == nil {
+		// A call the agent gave up on says nothing about the provider.
+		attempt.record(err != nil || resp.StatusCode >= 500, time.Since(sentAt))
+	}
+	if err != nil {
+		s.refundHold(hold, false)
+		if isTimeout(err) {
+			return nil, WriteJSON(w, http.StatusGatewayTimeout, ApiError{Error: "upstream timed out"})
+		}
+		return nil, WriteJSON(w, http.StatusBadGateway, ApiError{Error: "upstream unavailable"})
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		s.refundHold(hold, false)
+		return nil, writeUpstreamResponse(w, resp)
+	}
+
+	if !settlesOnUsage {
+		call.cost = s.captureHold(call, hold, service.Price)
+		body := &upstreamBody{ReadCloser: resp.Body}
+		resp.Body = body
+		err := writeUpstreamResponse(w, resp)
+		if body.err != nil {
+			// The provider cut the response short after it was paid for.
+			s.refundHold(hold, true)
+			call.cost = 0
+			return nil, err
+		}
+		return hold, err
+	}
+
+	limit := int64(parseIntOr(proxyMaxUsageBody, defaultMaxUsageBody))
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		s.refundHold(hold, false)
+		return nil, WriteJSON(w, http.StatusBadGateway, ApiError{Error: "upstream unavailable"})
+	}
+	if int64(len(body)) > limit {
+		s.releaseHold(hold.TransactionId)
+		return nil, WriteJSON(w, http.StatusBadGateway, ApiError{Error: "upstream response too large"})
+	}
+
+	call.cost = s.captureHold(call, hold, usageCost(extractor, body, service))
+
+	copyHeaders(w.Header(), resp.Header)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(resp.StatusCode)
+	_, err = w.Write(body)
+	return hold, err
+}
+
+func writeUpstreamResponse(w http.ResponseWriter, resp *http.Response) error {
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	_, err := io.Copy(w, resp.Body)
+	return err
+}
+
+// usageCost prices a response from the token usage it reports, bounded by the
+// service's max price. Services without token rates and responses without
+// readable usage are billed at the service's base price.
+func usageCost(extractor usage.Extractor, body []byte, service *shared.ProviderService) int64 {
+	if service.InputTokenPrice == 0 && service.OutputTokenPrice == 0 {
+		return service.Price
+	}
+	u, err := extractor.Extract(body)
+	if err != nil {
+		return service.Price
+	}
+	return min(usage.Cost(u, service.InputTokenPrice, service.OutputTokenPrice), service.MaxPrice)
+}
+
+// captureHold settles the hold at the final cost, bounded by the hold's cap,
+// and returns the amount captured. If the wallet or the API key's budget
+// cannot cover the part of the cost above the hold, the reserved amount is
+// captured instead so neither is ever overdrawn. The cost is kept on the call
+// for the audit log, where settlement finds it if the capture fails.
+func (s *APIServer) captureHold(call *proxyCall, hold *shared.Hold, cost int64) int64 {
+	cost = min(cost, hold.MaxAmount)
+	call.meteredCost = &cost
+
+	captured, err := s.storage.Capture(hold.TransactionId, cost)
+	if errors.Is(err, db.ErrInsufficientFunds) || errors.Is(err, db.ErrBudgetExceeded) {
+		captured, err = s.storage.Capture(hold.TransactionId, hold.Amount)
+	}
+	if err != nil {
+		log.Printf("failed to capture hold %v: %v", hold.TransactionId, err)
+		return 0
+	}
+	return captured.CapturedAmount
+}
+
+// refundHold gives the agent its money back when the upstream call failed
+// with a 5xx, a timeout, a dropped connection or a body cut short. A hold that
+// is not captured yet is captured at the reserved amount first, so that every
+// upstream failure ends the same way: Refund credits the wallet, marks the
+// CHARGE FAILED and records a REFUND linked to it. If the charge cannot be
+// captured the hold is voided instead. Failures are only logged; a refund
+// that did not go through can be retried from the admin API because Refund
+// is idempotent.
+func (s *APIServer) refundHold(hold *shared.Hold, captured bool) {
+	if !captured {
+		if _, err := s.storage.Capture(hold.TransactionId, hold.Amount); err != nil {
+			log.Printf("failed to capture hold %v for a refund: %v", hold.TransactionId, err)
+			s.releaseHold(hold.TransactionId)
+			return
+		}
+	}
+
+	_, err := s.storage.Refund(hold.TransactionId)
+	if errors.Is(err, db.ErrHoldNotCaptured) {
+		s.releaseHold(hold.TransactionId)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to refund charge %v: %v", hold.TransactionId, err)
+	}
+}
+
+// releaseHold voids the hold of a call that is not charged for without the
+// provider being at fault: the request was never sent, or the response was
+// too large to meter. Nothing left the wallet, so nothing is refunded.
+// Failures are only logged: the charge stays PENDING and the hold can be
+// voided again later because Void is idempotent.
+func (s *APIServer) releaseHold(transactionId uuid.UUID) {
+	if _, err := s.storage.Void(transactionId); err != nil {
+		log.Printf("failed to void hold %v: %v", transactionId, err)
+	}
+}
+
+// upstreamBody remembers why reading an upstream response failed, so that a
+// response the provider cut short can be told apart from one the agent
+// stopped reading.
+type upstreamBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func newUpstreamRequest(r *http.Request, target string) (*http.Request, error) {
+	if r.URL.RawQuery != "" {
+		target = target + "?" + r.URL.RawQuery
+	}
+
+	outReq, err := http.NewRequestWithContext(r.Context(), r.Method, target, r.Body)
+	if err != nil {
+		return nil, err
+	}
+	outReq.ContentLength = r.ContentLength
+
+	copyHeaders(outReq.Header, r.Header)
+	// The agent's credentials are for the gateway only.
+	outReq.Header.Del("Authorization")
+	outReq.Header.Del(ApiKeyHeader)
+	outReq.Header.Del(IdempotencyKeyHeader)
+
+	return outReq, nil
+}
+
+func copyHeaders(dst, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+	for _, h := range hopHeaders {
+		dst.Del(h)
+	}
+}
+
+func writeChargeError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, db.ErrInsufficientFunds) {
+		return WriteJSON(w, http.StatusPaymentRequired, ApiError{Error: "insufficient funds"})
+	} else if errors.Is(err, db.ErrBudgetExceeded) {
+		return WriteJSON(w, http.StatusPaymentRequired, ApiError{Error: "API key budget exceeded"})
+	} else if errors.Is(err, db.ErrWalletLimitExceeded) {
+		return WriteJSON(w, http.StatusPaymentRequired, ApiError{Error: "wallet spending limit exceeded"})
+	} else if errors.Is(err, db.ErrAmountNotGreaterThanZero) {
+		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "amount not greater than 0"})
+	} else if errors.Is(err, db.ErrIdempotencyKeyReused) {
+		return WriteJSON(w, http.StatusUnprocessableEntity, ApiError{Error: err.Error()})
+	} else if strings.Contains(err.Error(), "conflict") {
+		return WriteJSON(w, http.StatusServiceUnavailable, ApiError{Error: "system busy, please try again"})
+	}
+	return WriteJSON(w, http.StatusInternalServerError, ApiError{Error: err.Error()})
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+const defaultReconcilePendingAge = time.Hour
+
+var reconcilePendingAge = os.Getenv("RECONCILE_PENDING_AGE")
+
+// Reconcile checks every wallet against its history and the ledger and stores
+// a discrepancy report. Transactions PENDING for longer than
+// RECONCILE_PENDING_AGE are reported as stuck.
+func Reconcile(storage db.Storage) (*shared.ReconciliationReport, error) {
+	staleBefore := time.Now().UTC().Add(-parseDurationOr(reconcilePendingAge, defaultReconcilePendingAge))
+	return storage.Reconcile(staleBefore)
+}
+
+func (s *APIServer) handleReconciliation(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		report, err := s.storage.GetLatestReconciliationReport()
+		if err != nil {
+			if errors.Is(err, db.ErrReportNotFound) {
+				return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+			}
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, report)
+	}
+	if r.Method == "POST" {
+		report, err := Reconcile(s.storage)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, report)
+	}
+	return fmt.Errorf("method not allowed: %s", r.Method)
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+const ReplayedHeader string = "Idempotent-Replayed"
+
+const replayPollInterval = 100 * time.Millisecond
+
+// maxIdempotentBody bounds the request body read into memory to fingerprint
+// a call sent with an idempotency key, and the response body kept to replay
+// it.
+const maxIdempotentBody = 10 << 20
+
+var errRequestTooLarge = errors.New("request body too large")
+
+// forwardOnce forwards a call at most once per (API key, idempotency key).
+// A repeat of a charged call gets the stored response back without being
+// forwarded or charged again, and a repeat that arrives while the first
+// attempt is still running waits for it. Attempts that end without a charge
+// release the key so the agent can retry, as do calls whose response is too
+// large to store. A key reused for a call with a different method, path,
+// query or body is rejected with 422.
+func (s *APIServer) forwardOnce(w http.ResponseWriter, r *http.Request, call *proxyCall, idempotencyKey string) error {
+	requestHash, err := hashProxyRequest(r)
+	if err != nil {
+		if errors.Is(err, errRequestTooLarge) {
+			return WriteJSON(w, http.StatusRequestEntityTooLarge, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	claimId := uuid.New()
+	// A claim can only be legitimately held for as long as an upstream call
+	// may take; anything older belongs to a request that died.
+	claimTTL := s.proxyClient.Timeout + 5*time.Second
+	deadline := time.Now().Add(claimTTL)
+
+	for {
+		record, claimed, err := s.storage.ClaimIdempotencyKey(call.apiKeyId, idempotencyKey, requestHash, claimId, time.Now().UTC().Add(-claimTTL))
+		if errors.Is(err, db.ErrIdempotencyKeyReused) {
+			return WriteJSON(w, http.StatusUnprocessableEntity, ApiError{Error: err.Error()})
+		}
+		if err != nil && !errors.Is(err, db.ErrReplayNotFound) {
+			return err
+		}
+
+		if claimed {
+			break
+		}
+
+		if record != nil && record.Status == "COMPLETED" {
+			call.replayed = true
+			call.transactionId = record.TransactionId
+			return writeReplayedResponse(w, record)
+		}
+
+		if time.Now().After(deadline) {
+			return WriteJSON(w, http.StatusConflict, ApiError{Error: "a request with this idempotency key is still in progress"})
+		}
+
+		select {
+		case <-r.Context().Done():
+			return r.Context().Err()
+		case <-time.After(replayPollInterval):
+		}
+	}
+
+	rec := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	hold, err := s.forward(rec, r, call)
+
+	if hold == nil || err != nil {
+		if err := s.storage.ReleaseIdempotencyKey(call.apiKeyId, idempotencyKey, claimId); err != nil {
+			log.Printf("failed to release idempotency key %s: %v", idempotencyKey, err)
+		}
+		return err
+	}
+
+	// A truncated response must never be replayed, so a response too large to
+	// keep leaves the key free instead.
+	if rec.overflowed {
+		if err := s.storage.ReleaseIdempotencyKey(call.apiKeyId, idempotencyKey, claimId); err != nil {
+			log.Printf("failed to release idempotency key %s: %v", idempotencyKey, err)
+		}
+		return nil
+	}
+
+	record := &shared.ProxyResponse{
+		ApiKeyId:       call.apiKeyId,
+		IdempotencyKey: idempotencyKey,
+		ClaimId:        claimId,
+		StatusCode:     rec.statusCode,
+		Headers:        rec.Header().Clone(),
+		Body:           rec.body.Bytes(),
+		TransactionId:  &hold.TransactionId,
+	}
+	if err := s.storage.CompleteIdempotencyKey(record); err != nil {
+		log.Printf("failed to store response for idempotency key %s: %v", idempotencyKey, err)
+	}
+
+	return nil
+}
+
+func writeReplayedResponse(w http.ResponseWriter, record *shared.ProxyResponse) error {
+	for key, values := range record.Headers {
+		// The replay has a request ID of its own.
+		if key == RequestIdHeader {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(record.StatusCode)
+	_, err := w.Write(record.Body)
+	return err
+}
+
+// hashProxyRequest fingerprints what a proxied call asks for: its method,
+// path, query and body. The body is read into memory and put back so that it
+// can still be forwarded.
+func hashProxyRequest(r *http.Request) (string, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBody+1))
+	if err != nil {
+		return "", err
+	}
+	if len(body) > maxIdempotentBody {
+		return "", errRequestTooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s|%s|", r.Method, r.URL.Path, r.URL.RawQuery)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// responseRecorder passes a response through to the client while keeping a
+// copy of its status and body. It stops copying the body once it grows past
+// maxIdempotentBody and marks the recording as overflowed.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	body        bytes.Buffer
+	overflowed  bool
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if !rec.wroteHeader {
+		rec.statusCode = statusCode
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflowed {
+		if rec.body.Len()+len(b) > maxIdempotentBody {
+			rec.overflowed = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
@@ -1,14 +1,17 @@
 package server
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -21,6 +24,10 @@ import (
 
 const PREFIX string = "asym_sk_"
 
+const defaultRotationGracePeriod = 24 * time.Hour
+
+const shutdownTimeout = 30 * time.Second
+
 func WriteJSON(w http.ResponseWriter, status int, v any) error {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -42,14 +49,40 @@ func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 }
 
 type APIServer struct {
-	listenAddr string
-	storage    db.Storage
+	listenAddr  string
+	storage     db.Storage
+	proxyClient *http.Client
+	vault       *crypto.Vault
+	sweeper     *idempotencySweeper
+	auditor     *auditLogger
+	settlement  *settlementWorker
+	rebalancer  *shardRebalancer
+	batcher     *chargeBatcher
+	leases      *leaseCache
+	breakers    *breakerRegistry
 }
 
 func NewAPIServer(listenAddr string, storage db.Storage) *APIServer {
+	vault, err := crypto.NewVault(vaultMasterKey)
+	if err != nil {
+		log.Fatal("invalid VAULT_MASTER_KEY: ", err)
+	}
+
+	proxyClient := newProxyClient()
+	batcher := newChargeBatcher(storage)
+
 	return &APIServer{
-		listenAddr: listenAddr,
-		storage:    storage,
+		listenAddr:  listenAddr,
+		storage:     storage,
+		proxyClient: proxyClient,
+		vault:       vault,
+		sweeper:     newIdempotencySweeper(storage),
+		auditor:     newAuditLogger(storage),
+		settlement:  newSettlementWorker(storage, proxyClient.Timeout),
+		rebalancer:  newShardRebalancer(storage),
+		batcher:     batcher,
+		leases:      newLeaseCache(storage, batcher.Charge),
+		breakers:    newBreakerRegistry(),
 	}
 }
 
@@ -59,9 +92,79 @@ func (s *APIServer) Run() {
 	router.HandleFunc("/user", makeHTTPHandleFunc(s.handleUser))
 	router.HandleFunc("/user/{uuid}", withJWTAuth(makeHTTPHandleFunc(s.handleUserById)))
 	router.HandleFunc("/transaction", makeHTTPHandleFunc(s.handleTransaction))
-	router.HandleFunc("/api-keys", withJWTAuth(makeHTTPHandleFunc(s.handleCreateApiKey)))
+	router.HandleFunc("/api-keys", withJWTAuth(makeHTTPHandleFunc(s.handleApiKeys)))
+	router.HandleFunc("/api-keys/{uuid}", withJWTAuth(makeHTTPHandleFunc(s.handleApiKeyById)))
+	router.HandleFunc("/api-keys/{uuid}/rotate", withJWTAuth(makeHTTPHandleFunc(s.handleRotateApiKey)))
+	router.HandleFunc("/api-keys/{uuid}/budget", withJWTAuth(makeHTTPHandleFunc(s.handleApiKeyBudget)))
+	router.HandleFunc("/api-keys/{uuid}/scope", withJWTAuth(makeHTTPHandleFunc(s.handleApiKeyScope)))
+	router.HandleFunc("/orgs", withJWTAuth(makeHTTPHandleFunc(s.handleOrganizations)))
+	router.HandleFunc("/orgs/{uuid}", withJWTAuth(makeHTTPHandleFunc(s.handleOrganizationById)))
+	router.HandleFunc("/orgs/{uuid}/members", withJWTAuth(makeHTTPHandleFunc(s.handleOrganizationMembers)))
+	router.HandleFunc("/orgs/{uuid}/members/{member}", withJWTAuth(makeHTTPHandleFunc(s.handleOrganizationMember)))
+	router.HandleFunc("/orgs/{uuid}/api-keys", withJWTAuth(makeHTTPHandleFunc(s.handleOrganizationApiKeys)))
+	router.HandleFunc("/orgs/{uuid}/api-keys/{id}", withJWTAuth(makeHTTPHandleFunc(s.handleRevokeOrganizationApiKey)))
+	router.HandleFunc("/orgs/{uuid}/api-keys/{id}/rotate", withJWTAuth(makeHTTPHandleFunc(s.handleRotateOrganizationApiKey)))
+	router.HandleFunc("/orgs/{uuid}/api-keys/{id}/budget", withJWTAuth(makeHTTPHandleFunc(s.handleOrganizationApiKeyBudget)))
+	router.HandleFunc("/orgs/{uuid}/api-keys/{id}/scope", withJWTAuth(makeHTTPHandleFunc(s.handleOrganizationApiKeyScope)))
+	router.HandleFunc("/orgs/{uuid}/wallets", withJWTAuth(makeHTTPHandleFunc(s.handleOrganizationSubWallets)))
+	router.HandleFunc("/wallets", withJWTAuth(makeHTTPHandleFunc(s.handleSubWallets)))
+	router.HandleFunc("/wallets/{uuid}", withJWTAuth(makeHTTPHandleFunc(s.handleSubWalletById)))
+	router.HandleFunc("/wallets/{uuid}/limits", withJWTAuth(makeHTTPHandleFunc(s.handleSubWalletLimits)))
+	router.HandleFunc("/wallets/{uuid}/top-up", withJWTAuth(makeHTTPHandleFunc(s.handleTopUpSubWallet)))
+	router.HandleFunc("/wallets/{uuid}/sweep", withJWTAuth(makeHTTPHandleFunc(s.handleSweepSubWallet)))
+	router.HandleFunc("/wallets/{uuid}/api-keys", withJWTAuth(makeHTTPHandleFunc(s.handleSubWalletApiKeys)))
+	router.HandleFunc("/wallets/{uuid}/api-keys/{id}", withJWTAuth(makeHTTPHandleFunc(s.handleRevokeSubWalletApiKey)))
+	router.HandleFunc("/transfers", withJWTAuth(makeHTTPHandleFunc(s.handleCreateTransfer)))
+	router.HandleFunc("/holds", withJWTAuth(makeHTTPHandleFunc(s.handleCreateHold)))
+	router.HandleFunc("/holds/{uuid}/capture", withJWTAuth(makeHTTPHandleFunc(s.handleCaptureHold)))
+	router.HandleFunc("/holds/{uuid}/void", withJWTAuth(makeHTTPHandleFunc(s.handleVoidHold)))
+	router.HandleFunc("/v1/proxy/{provider}/{service}", s.withApiKeyAuth(makeHTTPHandleFunc(s.handleProxy)))
+	router.HandleFunc("/admin/transactions/{uuid}/refund", withAdminAuth(makeHTTPHandleFunc(s.handleRefundTransaction)))
+	router.HandleFunc("/admin/transactions/{uuid}/journal", withAdminAuth(makeHTTPHandleFunc(s.handleJournal)))
+	router.HandleFunc("/admin/users/{uuid}/ledger", withAdminAuth(makeHTTPHandleFunc(s.handleWalletLedger)))
+	router.HandleFunc("/admin/users/{uuid}/promo", withAdminAuth(makeHTTPHandleFunc(s.handleGrantPromoCredit)))
+	router.HandleFunc("/admin/users/{uuid}/shards", withAdminAuth(makeHTTPHandleFunc(s.handleBalanceShards)))
+	router.HandleFunc("/admin/providers", withAdminAuth(makeHTTPHandleFunc(s.handleProviders)))
+	router.HandleFunc("/admin/providers/{provider}/services", withAdminAuth(makeHTTPHandleFunc(s.handleProviderServices)))
+	router.HandleFunc("/admin/providers/{provider}/secrets", withAdminAuth(makeHTTPHandleFunc(s.handleProviderSecrets)))
+	router.HandleFunc("/admin/providers/{provider}/secrets/{id}", withAdminAuth(makeHTTPHandleFunc(s.handleRetireProviderSecret)))
+	router.HandleFunc("/admin/leases/{uuid}/release", withAdminAuth(makeHTTPHandleFunc(s.handleReleaseExpiredLease)))
+	router.HandleFunc("/admin/breakers", withAdminAuth(makeHTTPHandleFunc(s.handleBreakers)))
+	router.HandleFunc("/admin/reconciliation", withAdminAuth(makeHTTPHandleFunc(s.handleReconciliation)))
+	router.HandleFunc("/admin/metrics", withAdminAuth(makeHTTPHandleFunc(s.handleMetrics)))
+
+	go s.sweeper.run()
+	go s.settlement.run()
+	go s.rebalancer.run()
+	go s.leases.run()
+	s.auditor.start()
+
+	httpServer := &http.Server{Addr: s.listenAddr, Handler: router}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Println("failed to shut down cleanly: ", err)
+		}
+	}()
+
 	log.Println("Server is running on port: ", s.listenAddr)
-	http.ListenAndServe(s.listenAddr, router)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println("server stopped: ", err)
+		stop()
+	}
+
+	// Wait for in-flight requests before flushing what they logged.
+	<-shutdownDone
+	s.leases.Close()
+	s.auditor.Close()
 }
 
 func (s *APIServer) handleUser(w http.ResponseWriter, r *http.Request) error {
@@ -184,13 +287,17 @@ func (s *APIServer) handleCreateTransaction(w http.ResponseWriter, r *http.Reque
 			Type:           "CHARGE",
 			CreatedAt:      time.Now().UTC(),
 		}
-		tx, err := s.storage.Charge(newTransaction)
+		// Direct charges may be answered from a balance lease; proxied calls
+		// never are.
+		tx, err := s.leases.Charge(newTransaction)
 
 		if err != nil {
 			if errors.Is(err, db.ErrInsufficientFunds) {
 				return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "insufficient funds"})
 			} else if errors.Is(err, db.ErrAmountNotGreaterThanZero) {
 				return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "amount not greater than 0"})
+			} else if errors.Is(err, db.ErrIdempotencyKeyReused) {
+				return WriteJSON(w, http.StatusUnprocessableEntity, ApiError{Error: err.Error()})
 			} else if strings.Contains(err.Error(), "conflict") {
 				return WriteJSON(w, http.StatusServiceUnavailable, ApiError{Error: "system busy, please try again"})
 			} else {
@@ -212,6 +319,8 @@ func (s *APIServer) handleCreateTransaction(w http.ResponseWriter, r *http.Reque
 		if err != nil {
 			if errors.Is(err, db.ErrAmountNotGreaterThanZero) {
 				return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "amount not greater than 0"})
+			} else if errors.Is(err, db.ErrIdempotencyKeyReused) {
+				return WriteJSON(w, http.StatusUnprocessableEntity, ApiError{Error: err.Error()})
 			} else if strings.Contains(err.Error(), "conflict") {
 				return WriteJSON(w, http.StatusServiceUnavailable, ApiError{Error: "system busy, please try again"})
 			} else {
@@ -235,7 +344,8 @@ func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
 
 	user, err := s.storage.GetUserByUsername(loginRequest.Username)
 
-	if err != nil {
+	// Organizations have no password; their members log in instead.
+	if err != nil || user.Kind != "USER" {
 		return fmt.Errorf("Invalid username or password")
 	}
 
@@ -252,10 +362,30 @@ func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
 	return WriteJSON(w, http.StatusOK, jwt)
 }
 
-func (s *APIServer) handleCreateApiKey(w http.ResponseWriter, r *http.Request) error {
-	userId := r.Context().Value("userId")
+func (s *APIServer) handleApiKeys(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		return s.handleGetApiKeys(w, r)
+	}
+	if r.Method == "POST" {
+		return s.handleCreateApiKey(w, r)
+	}
+	return fmt.Errorf("method not allowed: %s", r.Method)
+}
+
+func (s *APIServer) handleGetApiKeys(w http.ResponseWriter, r *http.Request) error {
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
 
-	parsedUserId := userId.(uuid.UUID)
+	apiKeys, err := s.storage.GetApiKeysByUser(userId)
+
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, apiKeys)
+}
+
+func (s *APIServer) handleCreateApiKey(w http.ResponseWriter, r *http.Request) error {
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
 
 	apiKeyReq := new(CreateApiKeyRequest)
 
@@ -265,25 +395,227 @@ func (s *APIServer) handleCreateApiKey(w http.ResponseWriter, r *http.Request) e
 
 	defer r.Body.Close()
 
-	key, err := crypto.GenerateSecureToken(32)
+	key, apiKey, err := newApiKey(userId, apiKeyReq.Name, apiKeyReq.ExpiresInSeconds)
 
-	key = fmt.Sprintf("%v%v", PREFIX, key)
+	if err != nil {
+		return err
+	}
 
-	hashedKey := sha256.Sum256([]byte(key))
+	err = s.storage.CreateApiKey(apiKey)
 
-	apiKey := &shared.ApiKey{
-		ApiKey: hex.EncodeToString(hashedKey[:]),
-		UserId: parsedUserId,
-		Name:   apiKeyReq.Name,
+	if err != nil {
+		return err
 	}
 
-	err = s.storage.CreateApiKey(apiKey)
+	return WriteJSON(w, http.StatusOK, CreateApiKeyResponse{ApiKey: key, ApiKeyId: apiKey.ApiKeyId, ExpiresAt: apiKey.ExpiresAt})
+}
+
+func (s *APIServer) handleApiKeyById(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "DELETE" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	apiKeyId, err := getUUID(r)
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.storage.RevokeApiKey(userId, apiKeyId); err != nil {
+		if errors.Is(err, db.ErrApiKeyNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, apiKeyId)
+}
+
+func (s *APIServer) handleRotateApiKey(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	oldKeyId, err := getUUID(r)
+
+	if err != nil {
+		return err
+	}
+
+	return s.rotateApiKey(w, r, userId, oldKeyId)
+}
+
+// rotateApiKey replaces one of ownerId's keys with a new key issued to the
+// same owner.
+func (s *APIServer) rotateApiKey(w http.ResponseWriter, r *http.Request, ownerId uuid.UUID, oldKeyId uuid.UUID) error {
+	rotateReq := new(RotateApiKeyRequest)
+
+	// The body is optional; an empty one rotates with the defaults.
+	if err := json.NewDecoder(r.Body).Decode(rotateReq); err != nil && err != io.EOF {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	gracePeriod := defaultRotationGracePeriod
+	if rotateReq.GracePeriodSeconds != nil {
+		if *rotateReq.GracePeriodSeconds < 0 {
+			return fmt.Errorf("grace period must not be negative")
+		}
+		gracePeriod = time.Duration(*rotateReq.GracePeriodSeconds) * time.Second
+	}
+
+	key, apiKey, err := newApiKey(ownerId, "", rotateReq.ExpiresInSeconds)
 
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, CreateApiKeyResponse{ApiKey: key})
+	if err := s.storage.RotateApiKey(oldKeyId, apiKey, apiKey.CreatedAt.Add(gracePeriod)); err != nil {
+		if errors.Is(err, db.ErrApiKeyNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, CreateApiKeyResponse{ApiKey: key, ApiKeyId: apiKey.ApiKeyId, ExpiresAt: apiKey.ExpiresAt})
+}
+
+func (s *APIServer) handleApiKeyBudget(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "PUT" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	apiKeyId, err := getUUID(r)
+
+	if err != nil {
+		return err
+	}
+
+	return s.setApiKeyBudget(w, r, userId, apiKeyId)
+}
+
+func (s *APIServer) setApiKeyBudget(w http.ResponseWriter, r *http.Request, ownerId uuid.UUID, apiKeyId uuid.UUID) error {
+	budget := new(shared.ApiKeyBudget)
+
+	if err := json.NewDecoder(r.Body).Decode(budget); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if err := validateBudget(budget); err != nil {
+		return err
+	}
+
+	if err := s.storage.SetApiKeyBudget(ownerId, apiKeyId, budget); err != nil {
+		if errors.Is(err, db.ErrApiKeyNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, budget)
+}
+
+func validateBudget(budget *shared.ApiKeyBudget) error {
+	for _, limit := range []*int64{budget.HardCap, budget.DailyLimit, budget.WeeklyLimit, budget.MonthlyLimit} {
+		if limit != nil && *limit < 0 {
+			return fmt.Errorf("budget limits must not be negative")
+		}
+	}
+	return nil
+}
+
+func (s *APIServer) handleApiKeyScope(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "PUT" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	apiKeyId, err := getUUID(r)
+
+	if err != nil {
+		return err
+	}
+
+	return s.setApiKeyScope(w, r, userId, apiKeyId)
+}
+
+func (s *APIServer) setApiKeyScope(w http.ResponseWriter, r *http.Request, ownerId uuid.UUID, apiKeyId uuid.UUID) error {
+	scope := new(shared.ApiKeyScope)
+
+	if err := json.NewDecoder(r.Body).Decode(scope); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if scope.MaxCallCost != nil && *scope.MaxCallCost < 0 {
+		return fmt.Errorf("max call cost must not be negative")
+	}
+
+	for _, service := range scope.Services {
+		if service.Provider == "" || service.Service == "" {
+			return fmt.Errorf("scoped services need both a provider and a service")
+		}
+	}
+
+	for i, method := range scope.AllowedMethods {
+		method = strings.ToUpper(method)
+		if !proxyMethods[method] {
+			return fmt.Errorf("unsupported method: %s", method)
+		}
+		scope.AllowedMethods[i] = method
+	}
+
+	if err := s.storage.SetApiKeyScope(ownerId, apiKeyId, scope); err != nil {
+		if errors.Is(err, db.ErrApiKeyNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		}
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, scope)
+}
+
+// newApiKey generates a plaintext key and the record that stores its hash.
+// The plaintext is only ever returned to the caller once.
+func newApiKey(userId uuid.UUID, name string, expiresInSeconds int64) (string, *shared.ApiKey, error) {
+	if expiresInSeconds < 0 {
+		return "", nil, fmt.Errorf("expiry must not be negative")
+	}
+
+	key, err := crypto.GenerateSecureToken(32)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	key = fmt.Sprintf("%v%v", PREFIX, key)
+
+	apiKey := &shared.ApiKey{
+		ApiKey:     hashApiKey(key),
+		ApiKeyId:   uuid.New(),
+		UserId:     userId,
+		Name:       name,
+		PrefixHint: key[:len(PREFIX)+4],
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	if expiresInSeconds > 0 {
+		expiresAt := apiKey.CreatedAt.Add(time.Duration(expiresInSeconds) * time.Second)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	return key, apiKey, nil
 }
 
 func getUUID(r *http.Request) (uuid.UUID, error) {
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+const defaultSettlementTimeout = 10 * time.Minute
+
+const defaultSettlementInterval = time.Minute
+
+const settlementBatchSize = 100
+
+// A transaction that fails to settle is retried after the settlement interval,
+// then after twice as long each time, up to maxSettlementBackoff. Once it has
+// failed settlementAlertAttempts times it is reported as stuck.
+const maxSettlementBackoff = time.Hour
+
+const settlementAlertAttempts = 5
+
+var settlementTimeout = os.Getenv("SETTLEMENT_TIMEOUT")
+var settlementInterval = os.Getenv("SETTLEMENT_INTERVAL")
+
+// SettlementStats reports what the settlement worker has done since the
+// server started.
+type SettlementStats struct {
+	Timeout   string     `json:"timeout"`
+	Runs      int64      `json:"runs"`
+	Confirmed int64      `json:"confirmed"`
+	Captured  int64      `json:"captured"`
+	Voided    int64      `json:"voided"`
+	Failures  int64      `json:"failures"`
+	Stuck     int64      `json:"stuck"`
+	LastRunAt *time.Time `json:"lastRunAt"`
+}
+
+// settlementWorker closes transactions left PENDING, for example because the
+// gateway crashed between reserving money and hearing back from the provider.
+//
+// Deposits and charges without a hold are confirmed: the wallet was already
+// credited or debited in the same database transaction that created them.
+// A proxy hold is captured when the provider is known to have answered the
+// call below 500, at the metered cost the gateway recorded for it or, if none
+// was recorded, at its reserved amount. It is voided otherwise, which returns
+// the money to the wallet. Holds placed through POST /holds belong to their
+// owner and are never settled here. Each settled row records why it was
+// settled.
+type settlementWorker struct {
+	storage  db.Storage
+	timeout  time.Duration
+	interval time.Duration
+
+	mu    sync.Mutex
+	stats SettlementStats
+}
+
+func newSettlementWorker(storage db.Storage, proxyTimeout time.Duration) *settlementWorker {
+	// Never settle a call that may still be waiting for its provider.
+	timeout := max(parseDurationOr(settlementTimeout, defaultSettlementTimeout), 2*proxyTimeout)
+	return &settlementWorker{
+		storage:  storage,
+		timeout:  timeout,
+		interval: parseDurationOr(settlementInterval, defaultSettlementInterval),
+		stats:    SettlementStats{Timeout: timeout.String()},
+	}
+}
+
+func (sw *settlementWorker) run() {
+	ticker := time.NewTicker(sw.interval)
+	defer ticker.Stop()
+
+	for {
+		sw.settleStale()
+		<-ticker.C
+	}
+}
+
+func (sw *settlementWorker) settleStale() {
+	now := time.Now().UTC()
+	sw.record(func(stats *SettlementStats) {
+		stats.Runs++
+		stats.LastRunAt = &now
+	})
+
+	transactions, err := sw.storage.GetStalePendingTransactions(now.Add(-sw.timeout), now, settlementBatchSize)
+	if err != nil {
+		log.Println("failed to load stale transactions: ", err)
+		sw.record(func(stats *SettlementStats) { stats.Failures++ })
+		return
+	}
+
+	for _, transaction := range transactions {
+		if err := sw.settle(transaction); err != nil {
+			sw.record(func(stats *SettlementStats) { stats.Failures++ })
+			sw.deferSettlement(transaction, now, err)
+		}
+	}
+}
+
+// deferSettlement moves a transaction that failed to settle out of the way of
+// the next runs, and raises an alert once it keeps failing.
+func (sw *settlementWorker) deferSettlement(transaction *shared.Transaction, now time.Time, cause error) {
+	attempts, err := sw.storage.DeferSettlement(transaction.TransactionId, now, sw.interval, maxSettlementBackoff)
+	if err != nil {
+		log.Printf("failed to settle transaction %v: %v", transaction.TransactionId, cause)
+		log.Printf("failed to defer settlement of transaction %v: %v", transaction.TransactionId, err)
+		return
+	}
+
+	if attempts < settlementAlertAttempts {
+		log.Printf("failed to settle transaction %v (attempt %d): %v", transaction.TransactionId, attempts, cause)
+		return
+	}
+	log.Printf("ALERT: transaction %v is stuck PENDING after %d failed settlement attempts: %v", transaction.TransactionId, attempts, cause)
+	if attempts == settlementAlertAttempts {
+		sw.record(func(stats *SettlementStats) { stats.Stuck++ })
+	}
+}
+
+func (sw *settlementWorker) settle(transaction *shared.Transaction) error {
+	hold, err := sw.storage.GetHoldById(transaction.TransactionId)
+	if errors.Is(err, db.ErrHoldNotFound) {
+		reason := fmt.Sprintf("%s confirmed by settlement", transaction.Type)
+		confirmed, err := sw.storage.ConfirmTransaction(transaction.TransactionId, reason)
+		if confirmed {
+			sw.record(func(stats *SettlementStats) { stats.Confirmed++ })
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	capture, amount, reason, err := sw.holdOutcome(transaction, hold)
+	if err != nil {
+		return err
+	}
+
+	if capture {
+		_, err = sw.storage.Capture(hold.TransactionId, amount)
+		if amount > hold.Amount && (errors.Is(err, db.ErrInsufficientFunds) || errors.Is(err, db.ErrBudgetExceeded)) {
+			_, err = sw.storage.Capture(hold.TransactionId, hold.Amount)
+		}
+	} else {
+		_, err = sw.storage.Void(hold.TransactionId)
+	}
+	if errors.Is(err, db.ErrHoldClosed) {
+		// Its request settled it in the meantime.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sw.record(func(stats *SettlementStats) {
+		if capture {
+			stats.Captured++
+		} else {
+			stats.Voided++
+		}
+	})
+
+	return sw.storage.SetTransactionReason(hold.TransactionId, reason)
+}
+
+// holdOutcome decides whether a stale hold is captured, and for how much, or
+// voided, and why.
+func (sw *settlementWorker) holdOutcome(transaction *shared.Transaction, hold *shared.Hold) (bool, int64, string, error) {
+	statusCode, meteredCost, err := sw.storage.GetUpstreamResult(transaction.TransactionId)
+	if errors.Is(err, db.ErrNoUpstreamResult) {
+		return false, 0, "voided by settlement: no upstream result recorded", nil
+	}
+	if err != nil {
+		return false, 0, "", err
+	}
+
+	if statusCode >= 500 {
+		return false, 0, fmt.Sprintf("voided by settlement: upstream answered %d", statusCode), nil
+	}
+	if meteredCost == nil {
+		return true, hold.Amount, fmt.Sprintf("captured by settlement: upstream answered %d, no metered cost recorded", statusCode), nil
+	}
+	return true, min(*meteredCost, hold.MaxAmount), fmt.Sprintf("captured by settlement: upstream answered %d", statusCode), nil
+}
+
+func (sw *settlementWorker) record(update func(*SettlementStats)) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	update(&sw.stats)
+}
+
+func (sw *settlementWorker) Stats() SettlementStats {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.stats
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+)
+
+const defaultShardRebalanceInterval = 5 * time.Second
+
+var shardRebalanceInterval = os.Getenv("SHARD_REBALANCE_INTERVAL")
+
+// RebalancerStats reports what the shard rebalancer has done since the server
+// started.
+type RebalancerStats struct {
+	Runs           int64      `json:"runs"`
+	ShardedWallets int64      `json:"shardedWallets"`
+	Rebalanced     int64      `json:"rebalanced"`
+	Failures       int64      `json:"failures"`
+	LastRunAt      *time.Time `json:"lastRunAt"`
+}
+
+// shardRebalancer periodically spreads the money of sharded wallets evenly
+// over their shards again. Charges drain shards unevenly and deposits land on
+// the main row, so without it a sharded wallet degrades into charges queueing
+// on whichever rows still have funds.
+type shardRebalancer struct {
+	storage  db.Storage
+	interval time.Duration
+
+	mu    sync.Mutex
+	stats RebalancerStats
+}
+
+func newShardRebalancer(storage db.Storage) *shardRebalancer {
+	return &shardRebalancer{
+		storage:  storage,
+		interval: parseDurationOr(shardRebalanceInterval, defaultShardRebalanceInterval),
+	}
+}
+
+func (sr *shardRebalancer) run() {
+	ticker := time.NewTicker(sr.interval)
+	defer ticker.Stop()
+
+	for {
+		sr.rebalance()
+		<-ticker.C
+	}
+}
+
+func (sr *shardRebalancer) rebalance() {
+	now := time.Now().UTC()
+	sr.record(func(stats *RebalancerStats) {
+		stats.Runs++
+		stats.LastRunAt = &now
+	})
+
+	userIds, err := sr.storage.GetShardedWallets()
+	if err != nil {
+		log.Println("failed to load sharded wallets: ", err)
+		sr.record(func(stats *RebalancerStats) { stats.Failures++ })
+		return
+	}
+	sr.record(func(stats *RebalancerStats) { stats.ShardedWallets = int64(len(userIds)) })
+
+	for _, userId := range userIds {
+		rebalanced, err := sr.storage.RebalanceShards(userId)
+		if err != nil {
+			log.Printf("failed to rebalance wallet %v: %v", userId, err)
+			sr.record(func(stats *RebalancerStats) { stats.Failures++ })
+			continue
+		}
+		if rebalanced {
+			sr.record(func(stats *RebalancerStats) { stats.Rebalanced++ })
+		}
+	}
+}
+
+func (sr *shardRebalancer) record(update func(*RebalancerStats)) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	update(&sr.stats)
+}
+
+func (sr *shardRebalancer) Stats() RebalancerStats {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.stats
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+// Sub-wallets hang off a user's own wallet or an organization's. A user
+// manages their own sub-wallets with every right; for an organization's,
+// their role in it applies: viewers can read them, developers can also issue
+// keys, and admins can change limits and move money in and out.
+
+func (s *APIServer) handleSubWallets(w http.ResponseWriter, r *http.Request) error {
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	if r.Method == "GET" {
+		wallets, err := s.storage.GetSubWalletsByParent(userId)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, wallets)
+	}
+	if r.Method == "POST" {
+		return s.handleCreateSubWallet(w, r, userId)
+	}
+	return fmt.Errorf("method not allowed: %s", r.Method)
+}
+
+func (s *APIServer) handleOrganizationSubWallets(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		orgId, _, err := s.authorizeOrganization(r, "VIEWER")
+		if err != nil {
+			return writeOrganizationError(w, err)
+		}
+
+		wallets, err := s.storage.GetSubWalletsByParent(orgId)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, wallets)
+	}
+	if r.Method == "POST" {
+		orgId, _, err := s.authorizeOrganization(r, "ADMIN")
+		if err != nil {
+			return writeOrganizationError(w, err)
+		}
+		return s.handleCreateSubWallet(w, r, orgId)
+	}
+	return fmt.Errorf("method not allowed: %s", r.Method)
+}
+
+func (s *APIServer) handleCreateSubWallet(w http.ResponseWriter, r *http.Request, parentId uuid.UUID) error {
+	createWalletReq := new(CreateSubWalletRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(createWalletReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if createWalletReq.Name == "" {
+		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "name is required"})
+	}
+
+	if err := validateBudget(&createWalletReq.Limits); err != nil {
+		return err
+	}
+
+	wallet := &shared.SubWallet{
+		WalletId:  uuid.New(),
+		ParentId:  parentId,
+		Name:      createWalletReq.Name,
+		Limits:    createWalletReq.Limits,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := s.storage.CreateSubWallet(wallet); err != nil {
+		return writeSubWalletError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, wallet)
+}
+
+func (s *APIServer) handleSubWalletById(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	wallet, _, err := s.authorizeSubWallet(r, "VIEWER")
+
+	if err != nil {
+		return writeSubWalletError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, wallet)
+}
+
+func (s *APIServer) handleSubWalletLimits(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "PUT" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	wallet, _, err := s.authorizeSubWallet(r, "ADMIN")
+
+	if err != nil {
+		return writeSubWalletError(w, err)
+	}
+
+	limits := new(shared.ApiKeyBudget)
+
+	if err := json.NewDecoder(r.Body).Decode(limits); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if err := validateBudget(limits); err != nil {
+		return err
+	}
+
+	if err := s.storage.SetSubWalletLimits(wallet.WalletId, limits); err != nil {
+		return writeSubWalletError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, limits)
+}
+
+// handleTopUpSubWallet allocates money from the parent wallet to the
+// sub-wallet. The idempotency key belongs to the parent.
+func (s *APIServer) handleTopUpSubWallet(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	wallet, _, err := s.authorizeSubWallet(r, "ADMIN")
+
+	if err != nil {
+		return writeSubWalletError(w, err)
+	}
+
+	fundsReq := new(SubWalletFundsRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(fundsReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if fundsReq.IdempotencyKey == "" {
+		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "idempotencyKey is required"})
+	}
+
+	topUp, err := s.storage.Transfer(&shared.Transaction{
+		TransactionId:  uuid.New(),
+		UserId:         wallet.ParentId,
+		IdempotencyKey: fundsReq.IdempotencyKey,
+		Amount:         fundsReq.Amount,
+		Type:           "TRANSFER",
+		CounterpartyId: &wallet.WalletId,
+		CreatedAt:      time.Now().UTC(),
+	})
+
+	if err != nil {
+		return writeChargeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, topUp)
+}
+
+// handleSweepSubWallet returns unused money from the sub-wallet to its
+// parent. Leaving out the amount sweeps the whole available balance. The
+// idempotency key belongs to the sub-wallet.
+func (s *APIServer) handleSweepSubWallet(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	wallet, _, err := s.authorizeSubWallet(r, "ADMIN")
+
+	if err != nil {
+		return writeSubWalletError(w, err)
+	}
+
+	fundsReq := new(SubWalletFundsRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(fundsReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if fundsReq.IdempotencyKey == "" {
+		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "idempotencyKey is required"})
+	}
+
+	sweep, err := s.storage.SweepSubWallet(&shared.Transaction{
+		TransactionId:  uuid.New(),
+		UserId:         wallet.WalletId,
+		IdempotencyKey: fundsReq.IdempotencyKey,
+		Amount:         fundsReq.Amount,
+		Type:           "TRANSFER",
+		CounterpartyId: &wallet.ParentId,
+		CreatedAt:      time.Now().UTC(),
+	})
+
+	if err != nil {
+		return writeChargeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, sweep)
+}
+
+func (s *APIServer) handleSubWalletApiKeys(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		wallet, _, err := s.authorizeSubWallet(r, "VIEWER")
+		if err != nil {
+			return writeSubWalletError(w, err)
+		}
+
+		apiKeys, err := s.storage.GetApiKeysByUser(wallet.WalletId)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, apiKeys)
+	}
+	if r.Method == "POST" {
+		return s.handleCreateSubWalletApiKey(w, r)
+	}
+	return fmt.Errorf("method not allowed: %s", r.Method)
+}
+
+// handleCreateSubWalletApiKey issues a key that spends from the sub-wallet
+// only. Keys of an organization's sub-wallet are attributed to the member who
+// created them.
+func (s *APIServer) handleCreateSubWalletApiKey(w http.ResponseWriter, r *http.Request) error {
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	wallet, _, err := s.authorizeSubWallet(r, "DEVELOPER")
+
+	if err != nil {
+		return writeSubWalletError(w, err)
+	}
+
+	apiKeyReq := new(CreateApiKeyRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(apiKeyReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	key, apiKey, err := newApiKey(wallet.WalletId, apiKeyReq.Name, apiKeyReq.ExpiresInSeconds)
+
+	if err != nil {
+		return err
+	}
+
+	if wallet.ParentId != userId {
+		apiKey.MemberId = &userId
+	}
+
+	if err := s.storage.CreateApiKey(apiKey); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, CreateApiKeyResponse{ApiKey: key, ApiKeyId: apiKey.ApiKeyId, ExpiresAt: apiKey.ExpiresAt})
+}
+
+func (s *APIServer) handleRevokeSubWalletApiKey(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "DELETE" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	wallet, role, err := s.authorizeSubWallet(r, "DEVELOPER")
+
+	if err != nil {
+		return writeSubWalletError(w, err)
+	}
+
+	apiKeyId, err := uuid.Parse(mux.Vars(r)["id"])
+
+	if err != nil {
+		return fmt.Errorf("Invalid uuid given %s", mux.Vars(r)["id"])
+	}
+
+	return s.revokeMemberApiKey(w, wallet.WalletId, apiKeyId, userId, role)
+}
+
+// authorizeSubWallet loads the sub-wallet named by the request and checks
+// that the caller holds at least minRole over it. The owner of a personal
+// parent wallet counts as an OWNER.
+func (s *APIServer) authorizeSubWallet(r *http.Request, minRole string) (*shared.SubWallet, string, error) {
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	walletId, err := getUUID(r)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	wallet, err := s.storage.GetSubWallet(walletId)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	role := "OWNER"
+	if wallet.ParentId != userId {
+		role, err = s.storage.GetMemberRole(wallet.ParentId, userId)
+		if err != nil {
+			if errors.Is(err, db.ErrNotMember) {
+				return nil, "", db.ErrSubWalletNotFound
+			}
+			return nil, "", err
+		}
+	}
+
+	if roleRanks[role] < roleRanks[minRole] {
+		return nil, "", errInsufficientRole
+	}
+
+	return wallet, role, nil
+}
+
+func writeSubWalletError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, db.ErrSubWalletNotFound) {
+		return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+	} else if errors.Is(err, db.ErrSubWalletNameTaken) {
+		return WriteJSON(w, http.StatusConflict, ApiError{Error: err.Error()})
+	}
+	return writeOrganizationError(w, err)
+}
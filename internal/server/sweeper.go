@@ -0,0 +1,104 @@
+package server
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+)
+
+const defaultIdempotencyRetention = 24 * time.Hour
+
+const defaultIdempotencySweepInterval = time.Minute
+
+var idempotencyRetention = os.Getenv("IDEMPOTENCY_RETENTION")
+var idempotencySweepInterval = os.Getenv("IDEMPOTENCY_SWEEP_INTERVAL")
+
+// SweeperStats reports what the idempotency sweeper has pruned since the
+// server started.
+type SweeperStats struct {
+	Retention           string     `json:"retention"`
+	Runs                int64      `json:"runs"`
+	Failures            int64      `json:"failures"`
+	KeysExpired         int64      `json:"keysExpired"`
+	ResponsesPruned     int64      `json:"responsesPruned"`
+	LastRunAt           *time.Time `json:"lastRunAt"`
+	LastKeysExpired     int64      `json:"lastKeysExpired"`
+	LastResponsesPruned int64      `json:"lastResponsesPruned"`
+}
+
+// idempotencySweeper periodically frees idempotency keys that are older than
+// the retention window and deletes the responses stored for them.
+type idempotencySweeper struct {
+	storage   db.Storage
+	retention time.Duration
+	interval  time.Duration
+
+	mu    sync.Mutex
+	stats SweeperStats
+}
+
+func newIdempotencySweeper(storage db.Storage) *idempotencySweeper {
+	retention := parseDurationOr(idempotencyRetention, defaultIdempotencyRetention)
+	return &idempotencySweeper{
+		storage:   storage,
+		retention: retention,
+		interval:  parseDurationOr(idempotencySweepInterval, defaultIdempotencySweepInterval),
+		stats:     SweeperStats{Retention: retention.String()},
+	}
+}
+
+func (sw *idempotencySweeper) run() {
+	ticker := time.NewTicker(sw.interval)
+	defer ticker.Stop()
+
+	for {
+		sw.sweep()
+		<-ticker.C
+	}
+}
+
+func (sw *idempotencySweeper) sweep() {
+	before := time.Now().UTC().Add(-sw.retention)
+
+	keysExpired, keysErr := sw.storage.ExpireIdempotencyKeys(before)
+	if keysErr != nil {
+		log.Println("failed to expire idempotency keys: ", keysErr)
+	}
+	responsesPruned, responsesErr := sw.storage.PruneProxyResponses(before)
+	if responsesErr != nil {
+		log.Println("failed to prune stored responses: ", responsesErr)
+	}
+
+	now := time.Now().UTC()
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.stats.Runs++
+	if keysErr != nil || responsesErr != nil {
+		sw.stats.Failures++
+	}
+	sw.stats.KeysExpired += keysExpired
+	sw.stats.ResponsesPruned += responsesPruned
+	sw.stats.LastRunAt = &now
+	sw.stats.LastKeysExpired = keysExpired
+	sw.stats.LastResponsesPruned = responsesPruned
+}
+
+func (sw *idempotencySweeper) Stats() SweeperStats {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.stats
+}
+
+func parseDurationOr(value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
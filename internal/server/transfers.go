@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	db "github.com/minh20051202/ticket-system-backend/internal/database"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+func (s *APIServer) handleCreateTransfer(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	userId := r.Context().Value(userContextKey).(uuid.UUID)
+
+	createTransferReq := new(CreateTransferRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(createTransferReq); err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	if createTransferReq.IdempotencyKey == "" {
+		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "idempotencyKey is required"})
+	}
+
+	transfer, err := s.storage.Transfer(&shared.Transaction{
+		TransactionId:  uuid.New(),
+		UserId:         userId,
+		IdempotencyKey: createTransferReq.IdempotencyKey,
+		Amount:         createTransferReq.Amount,
+		Type:           "TRANSFER",
+		CounterpartyId: &createTransferReq.ToUserId,
+		CreatedAt:      time.Now().UTC(),
+	})
+
+	if err != nil {
+		if errors.Is(err, db.ErrRecipientNotFound) {
+			return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+		} else if errors.Is(err, db.ErrTransferToSelf) {
+			return WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+		}
+		return writeChargeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, transfer)
+}
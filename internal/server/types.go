@@ -1,7 +1,10 @@
 package server
 
 import (
+	"time"
+
 	"github.com/google/uuid"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
 )
 
 type CreateUserRequest struct {
@@ -17,9 +20,26 @@ type CreateTransactionRequest struct {
 	Type           string    `json:"type"`
 }
 
+type CreateTransferRequest struct {
+	ToUserId       uuid.UUID `json:"toUserId"`
+	IdempotencyKey string    `json:"idempotencyKey"`
+	Amount         int64     `json:"amount"`
+}
+
+type CreatePromoCreditRequest struct {
+	IdempotencyKey string `json:"idempotencyKey"`
+	Amount         int64  `json:"amount"`
+}
+
 type CreateApiKeyRequest struct {
-	UserId uuid.UUID `json:"userId"`
-	Name   string    `json:"name"`
+	UserId           uuid.UUID `json:"userId"`
+	Name             string    `json:"name"`
+	ExpiresInSeconds int64     `json:"expiresInSeconds"`
+}
+
+type RotateApiKeyRequest struct {
+	GracePeriodSeconds *int64 `json:"gracePeriodSeconds"`
+	ExpiresInSeconds   int64  `json:"expiresInSeconds"`
 }
 
 type LoginRequest struct {
@@ -28,5 +48,71 @@ type LoginRequest struct {
 }
 
 type CreateApiKeyResponse struct {
-	ApiKey string `json:"apiKey"`
+	ApiKey    string     `json:"apiKey"`
+	ApiKeyId  uuid.UUID  `json:"apiKeyId"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type CreateProviderRequest struct {
+	Name        string `json:"name"`
+	BaseURL     string `json:"baseUrl"`
+	AuthStyle   string `json:"authStyle"`
+	AuthParam   string `json:"authParam"`
+	UsageFormat string `json:"usageFormat"`
+}
+
+type UpsertProviderServiceRequest struct {
+	Name             string `json:"name"`
+	Path             string `json:"path"`
+	Price            int64  `json:"price"`
+	MaxPrice         int64  `json:"maxPrice"`
+	InputTokenPrice  int64  `json:"inputTokenPrice"`
+	OutputTokenPrice int64  `json:"outputTokenPrice"`
+}
+
+type CreateProviderSecretRequest struct {
+	Secret string `json:"secret"`
+}
+
+type CreateHoldRequest struct {
+	IdempotencyKey string `json:"idempotencyKey"`
+	Amount         int64  `json:"amount"`
+	MaxAmount      int64  `json:"maxAmount"`
+}
+
+type CaptureHoldRequest struct {
+	Amount int64 `json:"amount"`
+}
+
+type CreateOrganizationRequest struct {
+	Name         string `json:"name"`
+	BillingEmail string `json:"billingEmail"`
+}
+
+type AddOrganizationMemberRequest struct {
+	UserId uuid.UUID `json:"userId"`
+	Role   string    `json:"role"`
+}
+
+type UpdateOrganizationMemberRequest struct {
+	Role string `json:"role"`
+}
+
+type OrganizationResponse struct {
+	*shared.Organization
+	Balance *shared.Balance `json:"balance"`
+}
+
+type CreateSubWalletRequest struct {
+	Name   string              `json:"name"`
+	Limits shared.ApiKeyBudget `json:"limits"`
+}
+
+type SubWalletFundsRequest struct {
+	IdempotencyKey string `json:"idempotencyKey"`
+	Amount         int64  `json:"amount"`
+}
+
+type SetBalanceShardsRequest struct {
+	Count int `json:"count"`
 }
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+
+	"github.com/google/uuid"
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/minh20051202/ticket-system-backend/internal/shared"
+)
+
+var vaultMasterKey = os.Getenv("VAULT_MASTER_KEY")
+
+var errNoActiveSecret = errors.New("no active secret for provider")
+
+// injectProviderSecret picks one of the provider's active secrets, decrypts
+// it and places it on the outgoing request according to the provider's auth
+// style. It returns the id of the secret used, or uuid.Nil if the provider
+// does not need one.
+func (s *APIServer) injectProviderSecret(outReq *http.Request, provider *shared.Provider) (uuid.UUID, error) {
+	if provider.AuthStyle == "NONE" {
+		return uuid.Nil, nil
+	}
+
+	secrets, err := s.storage.GetActiveProviderSecrets(provider.ProviderId)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if len(secrets) == 0 {
+		return uuid.Nil, errNoActiveSecret
+	}
+
+	// Spreading calls across every active secret lets a new key take traffic
+	// before the old one is retired.
+	secret := secrets[rand.IntN(len(secrets))]
+
+	plaintext, err := s.vault.Decrypt(secret.Ciphertext, secret.SecretId[:])
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	switch provider.AuthStyle {
+	case "HEADER":
+		outReq.Header.Set(provider.AuthParam, string(plaintext))
+	case "BEARER":
+		outReq.Header.Set("Authorization", "Bearer "+string(plaintext))
+	case "QUERY":
+		query := outReq.URL.Query()
+		query.Set(provider.AuthParam, string(plaintext))
+		outReq.URL.RawQuery = query.Encode()
+	default:
+		return uuid.Nil, fmt.Errorf("unsupported auth style: %s", provider.AuthStyle)
+	}
+
+	return secret.SecretId, nil
+}
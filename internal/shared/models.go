@@ -1,6 +1,7 @@
 package shared
 
 import (
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,28 +12,263 @@ type User struct {
 	Username  string    `json:"username"`
 	Email     string    `json:"email"`
 	Password  string    `json:"-"`
+	Kind      string    `json:"kind"`
 	CreatedAt time.Time `json:"createdAt"`
 }
 
 type Balance struct {
 	UserId    uuid.UUID `json:"userId"`
 	Balance   int64     `json:"balance"`
+	Held      int64     `json:"held"`
+	Leased    int64     `json:"leased"`
+	Shards    int       `json:"shards"`
 	CreatedAt time.Time `json:"createdAt"`
 }
 
 type Transaction struct {
+	TransactionId       uuid.UUID  `json:"transactionId"`
+	UserId              uuid.UUID  `json:"userId"`
+	IdempotencyKey      string     `json:"idempotencyKey"`
+	Amount              int64      `json:"amount"`
+	Type                string     `json:"type"`
+	Status              string     `json:"status"`
+	StatusReason        string     `json:"statusReason,omitempty"`
+	ParentTransactionId *uuid.UUID `json:"parentTransactionId,omitempty"`
+	ApiKeyId            *uuid.UUID `json:"apiKeyId,omitempty"`
+	ProviderId          *uuid.UUID `json:"providerId,omitempty"`
+	CounterpartyId      *uuid.UUID `json:"counterpartyId,omitempty"`
+	MemberId            *uuid.UUID `json:"memberId,omitempty"`
+	CreatedAt           time.Time  `json:"createdAt"`
+}
+
+type ApiKey struct {
+	ApiKey     string       `json:"-"`
+	ApiKeyId   uuid.UUID    `json:"apiKeyId"`
+	UserId     uuid.UUID    `json:"userId"`
+	Name       string       `json:"name"`
+	PrefixHint string       `json:"prefixHint"`
+	LastUsedAt *time.Time   `json:"lastUsedAt"`
+	ExpiresAt  *time.Time   `json:"expiresAt"`
+	RevokedAt  *time.Time   `json:"revokedAt"`
+	Budget     ApiKeyBudget `json:"budget"`
+	Scope      ApiKeyScope  `json:"scope"`
+	MemberId   *uuid.UUID   `json:"memberId,omitempty"`
+	CreatedAt  time.Time    `json:"createdAt"`
+}
+
+type ApiKeyBudget struct {
+	HardCap      *int64 `json:"hardCap"`
+	DailyLimit   *int64 `json:"dailyLimit"`
+	WeeklyLimit  *int64 `json:"weeklyLimit"`
+	MonthlyLimit *int64 `json:"monthlyLimit"`
+}
+
+func (b *ApiKeyBudget) IsUnlimited() bool {
+	return b.HardCap == nil && b.DailyLimit == nil && b.WeeklyLimit == nil && b.MonthlyLimit == nil
+}
+
+type Provider struct {
+	ProviderId  uuid.UUID `json:"providerId"`
+	Name        string    `json:"name"`
+	BaseURL     string    `json:"baseUrl"`
+	AuthStyle   string    `json:"authStyle"`
+	AuthParam   string    `json:"authParam"`
+	UsageFormat string    `json:"usageFormat"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type ProviderService struct {
+	ServiceId        uuid.UUID `json:"serviceId"`
+	ProviderId       uuid.UUID `json:"providerId"`
+	Name             string    `json:"name"`
+	Path             string    `json:"path"`
+	Price            int64     `json:"price"`
+	MaxPrice         int64     `json:"maxPrice"`
+	InputTokenPrice  int64     `json:"inputTokenPrice"`
+	OutputTokenPrice int64     `json:"outputTokenPrice"`
+	CreatedAt        time.Time `json:"createdAt"`
+}
+
+type ProviderSecret struct {
+	SecretId   uuid.UUID  `json:"secretId"`
+	ProviderId uuid.UUID  `json:"providerId"`
+	Ciphertext []byte     `json:"-"`
+	Hint       string     `json:"hint"`
+	Status     string     `json:"status"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+type Hold struct {
 	TransactionId  uuid.UUID `json:"transactionId"`
 	UserId         uuid.UUID `json:"userId"`
-	IdempotencyKey string    `json:"idempotencyKey"`
 	Amount         int64     `json:"amount"`
-	Type           string    `json:"type"`
+	MaxAmount      int64     `json:"maxAmount"`
+	CapturedAmount int64     `json:"capturedAmount"`
 	Status         string    `json:"status"`
 	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
 }
 
-type ApiKey struct {
-	ApiKey    string    `json:"apiKey"`
+// ApiKeyScope restricts what a key may call. Empty lists and a nil cost mean
+// no restriction.
+type ApiKeyScope struct {
+	Services       []ServiceScope `json:"services"`
+	MaxCallCost    *int64         `json:"maxCallCost"`
+	AllowedMethods []string       `json:"allowedMethods"`
+}
+
+// ServiceScope allows one provider service, or every service of the provider
+// when Service is "*".
+type ServiceScope struct {
+	Provider string `json:"provider"`
+	Service  string `json:"service"`
+}
+
+func (s *ApiKeyScope) AllowsService(provider, service string) bool {
+	if len(s.Services) == 0 {
+		return true
+	}
+	for _, scope := range s.Services {
+		if scope.Provider == provider && (scope.Service == "*" || scope.Service == service) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ApiKeyScope) AllowsMethod(method string) bool {
+	if len(s.AllowedMethods) == 0 {
+		return true
+	}
+	for _, allowed := range s.AllowedMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+type ProxyResponse struct {
+	ApiKeyId       uuid.UUID           `json:"apiKeyId"`
+	IdempotencyKey string              `json:"idempotencyKey"`
+	ClaimId        uuid.UUID           `json:"claimId"`
+	RequestHash    string              `json:"-"`
+	Status         string              `json:"status"`
+	StatusCode     int                 `json:"statusCode"`
+	Headers        map[string][]string `json:"headers"`
+	Body           []byte              `json:"-"`
+	TransactionId  *uuid.UUID          `json:"transactionId"`
+	ClaimedAt      time.Time           `json:"claimedAt"`
+	CompletedAt    *time.Time          `json:"completedAt"`
+}
+
+// AuditEntry records one proxied call. Cost is what the agent was charged,
+// zero for calls that were rejected, failed upstream or replayed.
+type AuditEntry struct {
+	RequestId  uuid.UUID  `json:"requestId"`
+	UserId     uuid.UUID  `json:"userId"`
+	ApiKeyId   uuid.UUID  `json:"apiKeyId"`
+	MemberId   *uuid.UUID `json:"memberId,omitempty"`
+	Provider   string     `json:"provider"`
+	Service    string     `json:"service"`
+	Method     string     `json:"method"`
+	StatusCode int        `json:"statusCode"`
+	Cost       int64      `json:"cost"`
+	// MeteredCost is what the call was priced at once the provider answered,
+	// recorded even when capturing it failed so that settlement can.
+	MeteredCost   *int64     `json:"meteredCost,omitempty"`
+	TransactionId *uuid.UUID `json:"transactionId"`
+	Replayed      bool       `json:"replayed"`
+	DurationMs    int64      `json:"durationMs"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
+
+// WalletLedger compares a wallet's stored balance with its journal. The
+// wallet account sums to the balance plus what is held.
+type WalletLedger struct {
+	UserId        uuid.UUID `json:"userId"`
+	AccountId     uuid.UUID `json:"accountId"`
+	Balance       int64     `json:"balance"`
+	Held          int64     `json:"held"`
+	Leased        int64     `json:"leased"`
+	LedgerBalance int64     `json:"ledgerBalance"`
+	Consistent    bool      `json:"consistent"`
+}
+
+type JournalEntry struct {
+	EntryId       uuid.UUID    `json:"entryId"`
+	TransactionId *uuid.UUID   `json:"transactionId"`
+	Kind          string       `json:"kind"`
+	Legs          []JournalLeg `json:"legs"`
+	CreatedAt     time.Time    `json:"createdAt"`
+}
+
+// JournalLeg credits (positive amount) or debits (negative amount) one
+// account. The legs of an entry sum to zero.
+type JournalLeg struct {
+	AccountId   uuid.UUID  `json:"accountId"`
+	AccountType string     `json:"accountType"`
+	UserId      *uuid.UUID `json:"userId,omitempty"`
+	Amount      int64      `json:"amount"`
+}
+
+// ReconciliationReport is the result of one reconciliation run.
+type ReconciliationReport struct {
+	ReportId       uuid.UUID      `json:"reportId"`
+	WalletsChecked int            `json:"walletsChecked"`
+	Discrepancies  []*Discrepancy `json:"discrepancies"`
+	StartedAt      time.Time      `json:"startedAt"`
+	FinishedAt     time.Time      `json:"finishedAt"`
+}
+
+// Discrepancy is one violated invariant. Expected and Actual are set for
+// mismatched amounts.
+type Discrepancy struct {
+	Kind          string     `json:"kind"`
+	UserId        *uuid.UUID `json:"userId,omitempty"`
+	TransactionId *uuid.UUID `json:"transactionId,omitempty"`
+	Expected      *int64     `json:"expected,omitempty"`
+	Actual        *int64     `json:"actual,omitempty"`
+	Detail        string     `json:"detail"`
+}
+
+// Organization owns a shared wallet. Role is the requesting user's role in it.
+type Organization struct {
+	OrgId        uuid.UUID `json:"orgId"`
+	Name         string    `json:"name"`
+	BillingEmail string    `json:"billingEmail"`
+	Role         string    `json:"role,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+type OrganizationMember struct {
+	UserId    uuid.UUID `json:"userId"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// SubWallet is a child wallet with its own allocated balance, typically used
+// by one agent. Limits cap its spending the way a budget caps an API key's.
+type SubWallet struct {
+	WalletId  uuid.UUID    `json:"walletId"`
+	ParentId  uuid.UUID    `json:"parentId"`
+	Name      string       `json:"name"`
+	Limits    ApiKeyBudget `json:"limits"`
+	Balance   int64        `json:"balance"`
+	Held      int64        `json:"held"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+// BalanceLease is a slice of a wallet's balance reserved for one server
+// process to charge against in memory.
+type BalanceLease struct {
+	LeaseId   uuid.UUID `json:"leaseId"`
 	UserId    uuid.UUID `json:"userId"`
-	Name      string    `json:"name"`
+	Amount    int64     `json:"amount"`
+	Consumed  int64     `json:"consumed"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expiresAt"`
 	CreatedAt time.Time `json:"createdAt"`
 }
@@ -0,0 +1,95 @@
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+const tokensPerPriceUnit = 1_000_000
+
+var ErrNoUsage = errors.New("response has no usage information")
+
+type Usage struct {
+	InputTokens  int64 `json:"inputTokens"`
+	OutputTokens int64 `json:"outputTokens"`
+}
+
+// Extractor reads token usage out of an upstream response body.
+type Extractor interface {
+	Extract(body []byte) (*Usage, error)
+}
+
+type ExtractorFunc func(body []byte) (*Usage, error)
+
+func (f ExtractorFunc) Extract(body []byte) (*Usage, error) {
+	return f(body)
+}
+
+var (
+	mu         sync.RWMutex
+	extractors = map[string]Extractor{
+		"OPENAI":    ExtractorFunc(extractOpenAI),
+		"ANTHROPIC": ExtractorFunc(extractAnthropic),
+	}
+)
+
+// Register makes an extractor available under the given usage format name,
+// replacing any extractor already registered with that name.
+func Register(format string, extractor Extractor) {
+	mu.Lock()
+	defer mu.Unlock()
+	extractors[format] = extractor
+}
+
+func Get(format string) (Extractor, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	extractor, ok := extractors[format]
+	return extractor, ok
+}
+
+// Cost prices usage at the given per-million-token rates, rounding up so a
+// call is never billed below what it used.
+func Cost(u *Usage, inputTokenPrice, outputTokenPrice int64) int64 {
+	total := u.InputTokens*inputTokenPrice + u.OutputTokens*outputTokenPrice
+	return (total + tokensPerPriceUnit - 1) / tokensPerPriceUnit
+}
+
+func extractOpenAI(body []byte) (*Usage, error) {
+	var resp struct {
+		Usage *struct {
+			PromptTokens     int64 `json:"prompt_tokens"`
+			CompletionTokens int64 `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Usage == nil {
+		return nil, ErrNoUsage
+	}
+	return &Usage{
+		InputTokens:  resp.Usage.PromptTokens,
+		OutputTokens: resp.Usage.CompletionTokens,
+	}, nil
+}
+
+func extractAnthropic(body []byte) (*Usage, error) {
+	var resp struct {
+		Usage *struct {
+			InputTokens  int64 `json:"input_tokens"`
+			OutputTokens int64 `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Usage == nil {
+		return nil, ErrNoUsage
+	}
+	return &Usage{
+		InputTokens:  resp.Usage.InputTokens,
+		OutputTokens: resp.Usage.OutputTokens,
+	}, nil
+}
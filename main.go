@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
+	"os"
 
 	"github.com/minh20051202/ticket-system-backend/internal/database"
 	"github.com/minh20051202/ticket-system-backend/internal/server"
@@ -18,6 +20,31 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		reconcile(db)
+		return
+	}
+
 	server := server.NewAPIServer(":8080", db)
 	server.Run()
 }
+
+// reconcile prints a reconciliation report and exits non-zero when it found
+// discrepancies, so it can be run from cron.
+func reconcile(db *database.PostgresStore) {
+	report, err := server.Reconcile(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(report.Discrepancies) > 0 {
+		db.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,140 @@
+import http from "k6/http";
+import { check } from "k6";
+import { Counter } from "k6/metrics";
+
+// Shared no-oversell suite for every balance strategy. Run it once per
+// strategy, restarting the server in between:
+//
+//   BALANCE_STRATEGY=pessimistic ./bin/asymptotic-backend
+//   k6 run -e USER_ID=<wallet> -e ADMIN_KEY=<key> tests/k6/no_oversell.js
+//
+// and again with BALANCE_STRATEGY=optimistic and BALANCE_STRATEGY=atomic.
+// Batched charges go through the same strategy, so CHARGE_BATCH_WINDOW may
+// be set or not. TestNoOversell in internal/database runs the same check
+// against a test database without a server.
+// Setup tops the wallet up so it holds exactly STOCK, then more charges than
+// it can pay for race each other. The run fails unless the wallet never goes
+// negative, no more was sold than was in stock, and the balance, the
+// successful charges and the ledger all agree.
+
+const chargesSucceeded = new Counter("charges_succeeded");
+const chargesRejected = new Counter("charges_rejected");
+const systemBusy = new Counter("errors_system_busy");
+const otherErrors = new Counter("errors_other");
+const oversold = new Counter("oversold");
+
+// ------------------------------------------------------------------
+// CONFIGURATION
+// ------------------------------------------------------------------
+const BASE_URL = __ENV.BASE_URL || "http://localhost:8080";
+const USER_ID = __ENV.USER_ID;
+const ADMIN_KEY = __ENV.ADMIN_KEY;
+const STOCK = parseInt(__ENV.STOCK || "1000");
+const ATTEMPTS = parseInt(__ENV.ATTEMPTS || String(Math.floor((STOCK * 3) / 2)));
+const RUN_ID = `oversell-${Date.now()}`;
+
+export const options = {
+  scenarios: {
+    no_oversell: {
+      executor: "shared-iterations",
+      vus: parseInt(__ENV.VUS || "500"),
+      iterations: ATTEMPTS,
+    },
+  },
+  thresholds: {
+    oversold: ["count==0"],
+    errors_other: ["count==0"],
+  },
+};
+
+const jsonParams = { headers: { "Content-Type": "application/json" } };
+const adminParams = { headers: { "X-Admin-Key": ADMIN_KEY } };
+
+function walletLedger() {
+  const res = http.get(`${BASE_URL}/admin/users/${USER_ID}/ledger`, adminParams);
+  if (res.status !== 200) {
+    throw new Error(`cannot read wallet ${USER_ID} (${res.status}): ${res.body}`);
+  }
+  return res.json();
+}
+
+function post(path, body) {
+  return http.post(`${BASE_URL}${path}`, JSON.stringify(body), jsonParams);
+}
+
+export function setup() {
+  if (!USER_ID || !ADMIN_KEY) {
+    throw new Error("USER_ID and ADMIN_KEY are required");
+  }
+
+  const metrics = http.get(`${BASE_URL}/admin/metrics`, adminParams).json();
+  console.log(`balance strategy: ${metrics.balanceStrategy}`);
+
+  const start = walletLedger().balance;
+  if (start > STOCK) {
+    throw new Error(`wallet already holds ${start}, more than STOCK=${STOCK}`);
+  }
+  if (start < STOCK) {
+    const res = post("/transaction", {
+      userId: USER_ID,
+      idempotencyKey: `${RUN_ID}-stock`,
+      amount: STOCK - start,
+      type: "DEPOSIT",
+    });
+    if (res.status !== 200) {
+      throw new Error(`cannot stock the wallet (${res.status}): ${res.body}`);
+    }
+  }
+
+  return { stock: walletLedger().balance };
+}
+
+export default function () {
+  const res = post("/transaction", {
+    userId: USER_ID,
+    idempotencyKey: `${RUN_ID}-${__VU}-${__ITER}`,
+    amount: 1,
+    type: "CHARGE",
+  });
+
+  if (res.status === 200) {
+    chargesSucceeded.add(1);
+    return;
+  }
+
+  const body = res.body ? res.body.toString() : "";
+  if (body.includes("insufficient funds")) {
+    chargesRejected.add(1);
+  } else if (res.status === 503) {
+    // The optimistic strategy gives up after its retries.
+    systemBusy.add(1);
+  } else {
+    otherErrors.add(1);
+    console.error(`Unexpected Error (${res.status}): ${body}`);
+  }
+}
+
+export function teardown(data) {
+  const wallet = walletLedger();
+
+  const transactions = http.get(`${BASE_URL}/transaction`).json();
+  const sold = transactions.filter(
+    (t) =>
+      t.userId === USER_ID &&
+      t.type === "CHARGE" &&
+      t.status !== "FAILED" &&
+      t.idempotencyKey.startsWith(RUN_ID),
+  ).length;
+
+  const ok = check(wallet, {
+    "balance never negative": (w) => w.balance >= 0,
+    "sold no more than the stock": () => sold <= data.stock,
+    "balance matches the charges": (w) => w.balance === data.stock - sold,
+    "ledger matches the balance": (w) => w.consistent,
+  });
+  if (!ok) {
+    oversold.add(1);
+  }
+
+  console.log(`stock ${data.stock}, sold ${sold}, left ${wallet.balance}`);
+}